@@ -1,9 +1,11 @@
 package config
 
 import (
+	"strings"
 	"sync"
 
 	"github.com/winjeg/go-commons/conf"
+	"github.com/winjeg/go-commons/cryptos"
 	"github.com/winjeg/go-commons/log"
 	"github.com/winjeg/irisword/middleware"
 )
@@ -25,6 +27,19 @@ type (
 		Email    string `yaml:"email"`
 	}
 
+	TokenConfig struct {
+		Grace int `yaml:"grace"` // app token 轮换后老token 的宽限期， 单位秒
+	}
+
+	// QuotaConfig 每个app 默认的配额， 0 使用内置的默认值， 小于0 不限制
+	QuotaConfig struct {
+		Namespaces    int `json:"namespaces" yaml:"namespaces"`
+		NamespaceSize int `json:"namespaceSize" yaml:"namespaceSize"` // 单个namespace 内容的字节数
+		HistoryDepth  int `json:"historyDepth" yaml:"historyDepth"`   // 每个namespace 保留的历史版本数
+		Instances     int `json:"instances" yaml:"instances"`
+		HeartbeatRate int `json:"heartbeatRate" yaml:"heartbeatRate"` // 每个实例每分钟最多处理的心跳数
+	}
+
 	Settings struct {
 		Raft    RaftConfig               `json:"raft" yaml:"raft"`
 		Server  SeverConfig              `json:"server" yaml:"server"`
@@ -32,6 +47,8 @@ type (
 		JWT     middleware.JWTConfig     `json:"jwt" yaml:"jwt"`
 		Admin   AdminConfig              `json:"admin" yaml:"admin"`
 		Monitor middleware.MonitorConfig `json:"monitor" yaml:"monitor"`
+		Token   TokenConfig              `json:"token" yaml:"token"`
+		Quota   QuotaConfig              `json:"quota" yaml:"quota"`
 	}
 )
 
@@ -40,8 +57,22 @@ var (
 	confFileName = "conf.yaml"
 	projConf     *Settings
 	App          = getSettings()
+	innerToken   = cryptos.Sha1([]byte(App.JWT.Secret))
 )
 
+// InnerAuthHeader 集群内部节点之间转发请求时带上的请求头， 值为 InnerToken
+const InnerAuthHeader = "_inner_auth"
+
+// InnerToken 由JWT secret 生成， 集群内各节点一致
+func InnerToken() string {
+	return innerToken
+}
+
+// IsInner 请求头 InnerAuthHeader 的值是否为集群内部节点的
+func IsInner(auth string) bool {
+	return strings.EqualFold(auth, innerToken)
+}
+
 func initConf() {
 	projConf = new(Settings)
 	err := conf.Yaml2Object(confFileName, &projConf)
@@ -7,17 +7,19 @@ import (
 	"strings"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/gridsx/micro-conf/service/audit"
 	"github.com/gridsx/micro-conf/user"
 	"github.com/gridsx/micro-conf/user/session"
 	"github.com/kataras/iris/v12"
+	"github.com/winjeg/go-commons/str"
 	"github.com/winjeg/irisword/ret"
 )
 
 // RouteApp 以 /api/app 开头
-// 暂时不支持删除APP， 仅有管理员可以管理
+// 创建、复制与删除APP 仅有管理员可以操作
 
 func RouteAPI(app *iris.Application) {
-	app.Post("/api/app/reg", RequireToken, appStart)
+	app.Post("/api/app/reg", RequireScope(ScopeSvcRegister), appStart)
 }
 
 func RouteApp(party iris.Party) {
@@ -25,36 +27,196 @@ func RouteApp(party iris.Party) {
 	// 这段必须要放在前面，否则都需要admin权限了
 	userParty := party.Party("/user")
 	userParty.Get("/list", getUserApps)
+	userParty.Get("/search", searchUserApps)
+	userParty.Get("/feed", getUserFeed)
+	userParty.Get("/feed/ws", streamUserFeed)
 	userParty.Post("/bookmark", modifyUserBookmark)
 	userParty.Get("/{appId:string}", func(ctx iris.Context) { RequirePermission(ctx, Viewer) }, appDetail)
 
+	// 依赖关系图， 指定了 app 参数的需要有该app 的权限， 否则需要管理员
+	party.Get("/graph", func(ctx iris.Context) {
+		if len(ctx.URLParam("app")) == 0 {
+			RequireAdmin(ctx)
+			return
+		}
+		RequirePermission(ctx, Viewer)
+	}, appGraph)
 	// 角色管理
 	party.Post("/{app:string}/role", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageRole)
+	// token 轮换及各实例使用的token
+	party.Post("/{app:string}/token/rotate", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, rotateAppToken)
+	party.Get("/{app:string}/token/usage", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, appTokenUsage)
+	// 凭证管理
+	party.Get("/{app:string}/creds", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, listCredentials)
+	party.Post("/{app:string}/cred", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageCredential)
+	// group 管理
+	party.Post("/{app:string}/group", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageGroup)
+	// webhook 管理及投递记录
+	party.Get("/{app:string}/hooks", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, listHooks)
+	party.Post("/{app:string}/hook", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageHook)
+	party.Get("/{app:string}/hook/logs", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, hookLogs)
+	// 人工下线与恢复实例
+	party.Get("/{app:string}/overrides", func(ctx iris.Context) { RequirePermission(ctx, Viewer) }, listOverrides)
+	party.Post("/{app:string}/instance", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageInstance)
+	// 实例的主动健康检查
+	party.Get("/{app:string}/health", func(ctx iris.Context) { RequirePermission(ctx, Viewer) }, listHealthChecks)
+	party.Post("/{app:string}/health", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, manageHealthCheck)
 	// 应用启动的时候注册app到配置中心的接口， RequireToken
 
 	party.Use(RequireAdmin)
 	party.Get("/list", RequireAdmin, allAppList)                                                    // 获取APP列表
+	party.Get("/search", searchAllApps)                                                             // 搜索APP， 分页返回
 	party.Post("/new", createApp)                                                                   // 创建APP
+	party.Get("/templates", listTemplates)                                                          // 模板列表
+	party.Post("/template", modifyTemplate)                                                         // 新增或修改模板
+	party.Delete("/template/{name:string}", deleteTemplate)                                         // 删除模板
+	party.Post("/{app:string}/clone", cloneAppHandler)                                              // 复制APP
+	party.Get("/orphans", orphanReport)                                                             // 没有可用Owner 或者长期没有实例的APP
+	party.Post("/transfer", transferApps)                                                           // 转移APP 的Owner
+	party.Put("/{app:string}/quota", modifyQuota)                                                   // 设置APP 的配额
+	party.Delete("/{app:string}", removeAppHandler)                                                 // 删除APP， 有存活实例需要 force=true
 	party.Put("/{app:string}", func(ctx iris.Context) { RequirePermission(ctx, Owner) }, modifyApp) // 修改APP信息
 }
 
-// 创建App， 目前也只有管理员有权限
+// 创建App， 目前也只有管理员有权限， 可以通过参数 template 指定模板
 func createApp(ctx iris.Context) {
 	appInfo := new(AppInfo)
 	if err := ctx.ReadJSON(appInfo); err != nil {
 		ret.BadRequest(ctx, err.Error())
 		return
 	}
+	var tpl *Template
+	if name := ctx.URLParam("template"); len(name) > 0 {
+		t, err := FindTemplate(name)
+		if err != nil {
+			ret.BadRequest(ctx, "template does not exist")
+			return
+		}
+		tpl = t
+	}
 	userInfo := session.GetUserInfo(ctx)
 	appInfo.Creator = userInfo.Username
-	if err := newApp(appInfo); err != nil {
+	if err := newApp(appInfo, tpl); err != nil {
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	audit.Record(ctx, "app.create", "app:"+appInfo.AppId, nil, appInfo.masked())
 	ret.Ok(ctx, appInfo)
 }
 
-// 仅支持修改App名称描述和部门信息
+// 复制App， 与创建App 一样只有管理员有权限
+func cloneAppHandler(ctx iris.Context) {
+	req := new(CloneRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	userInfo := session.GetUserInfo(ctx)
+	info, err := cloneApp(ctx.Params().Get("app"), req, userInfo.Username)
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "app.clone", "app:"+info.AppId, "app:"+ctx.Params().Get("app"), info.masked())
+	ret.Ok(ctx, info)
+}
+
+func removeAppHandler(ctx iris.Context) {
+	operator := ""
+	if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		operator = userInfo.Username
+	}
+	record, err := deleteApp(ctx.Params().Get("app"), operator, ctx.URLParamBoolDefault("force", false))
+	if err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "app.delete", "app:"+ctx.Params().Get("app"), record.App.masked(), nil)
+	ret.Ok(ctx, record)
+}
+
+// 参数 days 指定多少天没有实例视为闲置， 默认30天
+func orphanReport(ctx iris.Context) {
+	ret.Ok(ctx, orphanApps(ctx.URLParamIntDefault("days", defaultOrphanDays)))
+}
+
+func transferApps(ctx iris.Context) {
+	req := new(TransferRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	apps, err := transferOwnership(req)
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "app.transfer", "apps:"+str.Join(apps, ","), "owner:"+req.From, "owner:"+req.To)
+	ret.Ok(ctx, apps)
+}
+
+// 覆盖默认的配额， 字段为0 的使用默认值
+func modifyQuota(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	if info, _ := FindApp(appId); info == nil {
+		ret.BadRequest(ctx, "app does not exist")
+		return
+	}
+	q := new(Quota)
+	if err := ctx.ReadJSON(q); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	before := EffectiveQuota(appId)
+	if err := setQuotaOverride(appId, q); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "app.quota", "app:"+appId, before, EffectiveQuota(appId))
+	ret.Ok(ctx, appQuota(appId))
+}
+
+func listTemplates(ctx iris.Context) {
+	ret.Ok(ctx, allTemplates())
+}
+
+func modifyTemplate(ctx iris.Context) {
+	tpl := new(Template)
+	if err := ctx.ReadJSON(tpl); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if existed, _ := FindTemplate(tpl.Name); existed != nil {
+		tpl.Creator, tpl.CreateTime = existed.Creator, existed.CreateTime
+	} else if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		tpl.Creator = userInfo.Username
+	}
+	before, _ := FindTemplate(tpl.Name)
+	if err := saveTemplate(tpl); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "template.save", "template:"+tpl.Name, before, tpl)
+	ret.Ok(ctx, tpl)
+}
+
+func deleteTemplate(ctx iris.Context) {
+	name := ctx.Params().Get("name")
+	before, _ := FindTemplate(name)
+	if err := removeTemplate(name); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "template.delete", "template:"+name, before, nil)
+	ret.Ok(ctx)
+}
+
+// 参数 depth 为与 app 相距的跳数， 默认1
+func appGraph(ctx iris.Context) {
+	ret.Ok(ctx, dependencyGraph(ctx.URLParam("app"), ctx.URLParamIntDefault("depth", defaultGraphDepth)))
+}
+
+// 仅支持修改App名称描述、部门信息以及声明的依赖
 func modifyApp(ctx iris.Context) {
 	appId := ctx.Params().Get("app")
 	appInfo := new(AppInfo)
@@ -63,17 +225,22 @@ func modifyApp(ctx iris.Context) {
 		return
 	}
 	appInfo.AppId = appId
+	before, _ := FindApp(appId)
 	if err := modifyAppInfo(appInfo); err != nil {
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	after, _ := FindApp(appId)
+	audit.Record(ctx, "app.modify", "app:"+appId, before.masked(), after.masked())
 	ret.Ok(ctx)
 }
 
 type roleRequest struct {
 	Action string `json:"action"`
 	Role   string `json:"role"`
-	User   string `json:"user"`
+	User   string `json:"user,omitempty"`
+	Team   string `json:"team,omitempty"`  // 授予团队， 与 user 二选一
+	Group  string `json:"group,omitempty"` // 为空则是整个app 的角色
 }
 
 // 管理App对应的角色， 目前只有管理员有权限
@@ -84,36 +251,263 @@ func manageRole(ctx iris.Context) {
 		ret.BadRequest(ctx, err.Error())
 		return
 	}
-	if u, err := user.FindUser(req.User); u == nil || err != nil {
+	principal := req.User
+	if len(req.Team) > 0 {
+		if t, err := user.FindTeam(req.Team); t == nil || err != nil {
+			ret.BadRequest(ctx, "team does not exist")
+			return
+		}
+		principal = user.TeamPrincipal(req.Team)
+	} else if u, err := user.FindUser(req.User); u == nil || err != nil {
 		ret.BadRequest(ctx, "user does not exist")
 		return
 	}
 
+	before, _ := FindApp(appId)
 	switch req.Action {
 	case "add":
-		if err := addRole(role(req.Role), appId, req.User); err != nil {
+		if err := addRole(role(req.Role), appId, req.Group, principal); err != nil {
 			ret.ServerError(ctx, err.Error())
 			return
 		} else {
-			if err := addUserApp(req.User, appId); err != nil {
+			if err := addUserApp(principal, appId); err != nil {
 				logger.Errorln("manageRole - add user error: " + err.Error())
 			}
 		}
 	case "remove", "del":
-		if err := removeRole(role(req.Role), appId, req.User); err != nil {
+		if err := removeRole(role(req.Role), appId, req.Group, principal); err != nil {
 			ret.ServerError(ctx, err.Error())
 			return
-		} else {
-			if err := removeUserApp(req.User, appId); err != nil {
+		} else if info, _ := FindApp(appId); info != nil && !str.Contains(info.members(), principal) {
+			// 在其他group 上仍有角色的， 保留在用户的app 列表中
+			if err := removeUserApp(principal, appId); err != nil {
 				logger.Errorln("manageRole - remove user error: " + err.Error())
 			}
 		}
 	default:
 		ret.BadRequest(ctx, "unknown action")
+		return
+	}
+	data := map[string]interface{}{"action": req.Action, "role": req.Role, "principal": principal, "group": req.Group}
+	if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		data["operator"] = userInfo.Username
+	}
+	Notify(appId, HookRoleChange, data)
+	after, _ := FindApp(appId)
+	audit.Record(ctx, "app.role."+req.Action, "app:"+appId, appRoles(before), appRoles(after))
+	ret.Ok(ctx)
+}
+
+type rotateRequest struct {
+	Grace int `json:"grace"` // 老token 的宽限期， 单位秒， 0 使用默认配置， 小于0 立即失效
+}
+
+func rotateAppToken(ctx iris.Context) {
+	req := new(rotateRequest)
+	if ctx.GetContentLength() > 0 {
+		if err := ctx.ReadJSON(req); err != nil {
+			ret.BadRequest(ctx, err.Error())
+			return
+		}
+	}
+	info, err := rotateToken(ctx.Params().Get("app"), req.Grace)
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	data := map[string]interface{}{"prevTokenExpire": info.PrevTokenExpire}
+	if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		data["operator"] = userInfo.Username
+	}
+	Notify(info.AppId, HookTokenRotate, data)
+	audit.Record(ctx, "app.token.rotate", "app:"+info.AppId, nil, data)
+	ret.Ok(ctx, info)
+}
+
+func appTokenUsage(ctx iris.Context) {
+	usage, err := tokenUsage(ctx.Params().Get("app"))
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, usage)
+}
+
+type credRequest struct {
+	Action string `json:"action"`
+	Credential
+}
+
+func listCredentials(ctx iris.Context) {
+	ret.Ok(ctx, appCredentials(ctx.Params().Get("app")))
+}
+
+// 新增的凭证会返回secret， 之后不再返回
+func manageCredential(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	req := new(credRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	switch req.Action {
+	case "add":
+		cred := &req.Credential
+		if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+			cred.Creator = userInfo.Username
+		}
+		if err := addCredential(appId, cred); err != nil {
+			ret.BadRequest(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.cred.add", "app:"+appId, nil, map[string]interface{}{"name": cred.Name, "scopes": cred.Scopes})
+		ret.Ok(ctx, cred)
+	case "remove", "del":
+		if err := removeCredential(appId, req.Name); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.cred.del", "app:"+appId, map[string]interface{}{"name": req.Name}, nil)
+		ret.Ok(ctx)
+	default:
+		ret.BadRequest(ctx, "unknown action")
+	}
+}
+
+type groupRequest struct {
+	Action string `json:"action"`
+	Group  string `json:"group"`
+	Name   string `json:"name,omitempty"` // 重命名后的名称
+	From   string `json:"from,omitempty"` // 新增时从此group 复制namespace
+}
+
+func manageGroup(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	req := new(groupRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	var err error
+	switch req.Action {
+	case "add":
+		err = addGroup(appId, req.Group, req.From)
+	case "rename":
+		err = renameGroup(appId, req.Group, req.Name)
+	case "remove", "del":
+		err = removeGroup(appId, req.Group)
+	default:
+		ret.BadRequest(ctx, "unknown action")
+		return
 	}
+	if err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	audit.Record(ctx, "app.group."+req.Action, "app:"+appId, nil, req)
 	ret.Ok(ctx)
 }
 
+type hookRequest struct {
+	Action string   `json:"action"`
+	Id     string   `json:"id"`
+	Url    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+func listHooks(ctx iris.Context) {
+	ret.Ok(ctx, appHooks(ctx.Params().Get("app")))
+}
+
+func manageHook(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	req := new(hookRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	switch req.Action {
+	case "add":
+		hook := &Webhook{Url: req.Url, Events: req.Events}
+		if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+			hook.Creator = userInfo.Username
+		}
+		if err := addHook(appId, hook); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.hook.add", "app:"+appId, nil, hook)
+		ret.Ok(ctx, hook)
+	case "remove", "del":
+		if err := removeHook(appId, req.Id); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.hook.del", "app:"+appId, map[string]interface{}{"id": req.Id}, nil)
+		ret.Ok(ctx)
+	default:
+		ret.BadRequest(ctx, "unknown action")
+	}
+}
+
+func hookLogs(ctx iris.Context) {
+	ret.Ok(ctx, hookDeliveries(ctx.Params().Get("app")))
+}
+
+type instanceRequest struct {
+	Action string `json:"action"` // offline 人工下线， online 解除人工设置
+	Group  string `json:"group"`
+	IP     string `json:"ip"`
+	Port   int    `json:"port"`
+	State  string `json:"state,omitempty"` // 下线后的状态， 默认 DOWN
+	Reason string `json:"reason,omitempty"`
+}
+
+func listOverrides(ctx iris.Context) {
+	ret.Ok(ctx, appOverrides(ctx.Params().Get("app")))
+}
+
+// 人工下线或者恢复实例， 状态变化会通知订阅方
+func manageInstance(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	req := new(instanceRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if len(req.Group) == 0 || len(req.IP) == 0 || req.Port < 1 {
+		ret.BadRequest(ctx, "group, ip and port required")
+		return
+	}
+	target := fmt.Sprintf("instance:%s/%s/%s:%d", appId, req.Group, req.IP, req.Port)
+	switch req.Action {
+	case "offline":
+		o := &InstanceOverride{App: appId, Group: req.Group, IP: req.IP, Port: req.Port, State: req.State, Reason: req.Reason}
+		if len(o.State) == 0 {
+			o.State = StateDown
+		}
+		if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+			o.Operator = userInfo.Username
+		}
+		if err := overrideInstance(o); err != nil {
+			ret.BadRequest(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.instance.offline", target, o.Reported, o)
+		ret.Ok(ctx, o)
+	case "online":
+		o, err := clearOverride(appId, req.Group, req.IP, req.Port)
+		if err != nil {
+			ret.BadRequest(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.instance.online", target, o, o.Reported)
+		ret.Ok(ctx)
+	default:
+		ret.BadRequest(ctx, "unknown action")
+	}
+}
+
 func appStart(ctx iris.Context) {
 	instInfo := new(InstanceInfo)
 	if err := ctx.ReadJSON(instInfo); err != nil {
@@ -127,6 +521,29 @@ func appStart(ctx iris.Context) {
 	ret.Ok(ctx)
 }
 
+func searchAllApps(ctx iris.Context) {
+	ret.Ok(ctx, searchApps(allApps(), readAppQuery(ctx)))
+}
+
+// 在用户有权限的app 中搜索， 参数 bookmark=true 时在收藏中搜索
+func searchUserApps(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	if userInfo == nil {
+		ret.Unauthorized(ctx)
+		return
+	}
+	list := appList(userInfo.Username)
+	apps := list.Apps
+	if ctx.URLParamBoolDefault("bookmark", false) {
+		apps = list.Bookmarks
+	}
+	infos := make([]*AppInfo, 0, len(apps))
+	for _, info := range apps {
+		infos = append(infos, info)
+	}
+	ret.Ok(ctx, searchApps(infos, readAppQuery(ctx)))
+}
+
 func getUserApps(ctx iris.Context) {
 	userInfo := session.GetUserInfo(ctx)
 	ret.Ok(ctx, appList(userInfo.Username))
@@ -206,6 +623,7 @@ func appDetail(ctx iris.Context) {
 	result["app"] = appInfo
 	result["groups"] = groupMap
 	result["namespaces"] = nsMap
+	result["quota"] = appQuota(appId)
 	ret.Ok(ctx, result)
 }
 
@@ -222,3 +640,50 @@ func allAppList(ctx iris.Context) {
 	ret.Ok(ctx, appMap)
 	return
 }
+
+type healthRequest struct {
+	Action string `json:"action"` // set 新增或者修改， del 删除
+	HealthCheck
+}
+
+// 各group 的健康检查定义以及当前不健康的实例
+func listHealthChecks(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	checks := appHealthChecks(appId)
+	result := make([]map[string]interface{}, 0, len(checks))
+	for _, h := range checks {
+		result = append(result, map[string]interface{}{"check": h, "unhealthy": unhealthyInstances(appId, h.Group)})
+	}
+	ret.Ok(ctx, result)
+}
+
+func manageHealthCheck(ctx iris.Context) {
+	appId := ctx.Params().Get("app")
+	req := new(healthRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	h := &req.HealthCheck
+	h.App = appId
+	before := FindHealthCheck(appId, h.Group)
+	target := fmt.Sprintf("health:%s/%s", appId, h.Group)
+	switch req.Action {
+	case "set":
+		if err := saveHealthCheck(h); err != nil {
+			ret.BadRequest(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.health.set", target, before, h)
+		ret.Ok(ctx, h)
+	case "remove", "del":
+		if err := removeHealthCheck(appId, h.Group); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
+		audit.Record(ctx, "app.health.del", target, before, nil)
+		ret.Ok(ctx)
+	default:
+		ret.BadRequest(ctx, "unknown action")
+	}
+}
@@ -24,7 +24,8 @@ const (
 
 var rs = store.GetRaftStore()
 
-func newApp(info *AppInfo) error {
+// 指定了模板的， 按模板创建group以及namespace， 否则只有一个默认的 default/app.props
+func newApp(info *AppInfo, tpl *Template) error {
 	if info == nil || info.Valid() != nil {
 		return errors.New("app info invalid")
 	}
@@ -34,15 +35,38 @@ func newApp(info *AppInfo) error {
 	appToken := str.RandomNumAlphabets(tokenLen)
 	info.Token = appToken
 	info.CreateTime = time.Now().Format(time.RFC3339)
-	info.Groups = "default"
+	info.Groups = defaultGroup
+	// 模板中的namespace 只渲染一次， 检查配额与创建使用同样的内容
+	var contents []string
+	if tpl != nil {
+		info.Groups = str.Join(tpl.AllGroups(), ",")
+		info.Template = tpl.Name
+		contents = make([]string, 0, len(tpl.Namespaces))
+		for _, ns := range tpl.Namespaces {
+			contents = append(contents, ns.Render(TemplateVars(info.AppId, ns.Group, ns.Namespace)))
+		}
+		if err := checkNewNamespaces(info.AppId, contents); err != nil {
+			return err
+		}
+	}
 	appKey := fmt.Sprintf(appInfoPattern, info.AppId)
-	createDefaultNamespace(info.AppId, "default", "app.props")
+	if tpl == nil {
+		if err := createDefaultNamespace(info.AppId, defaultGroup, defaultNamespace, ""); err != nil {
+			logger.Errorln("newApp - create default namespace error: " + err.Error())
+		}
+	} else {
+		for i, ns := range tpl.Namespaces {
+			if err := createDefaultNamespace(info.AppId, ns.Group, ns.Namespace, contents[i]); err != nil {
+				logger.Errorln("newApp - create template namespace error: " + err.Error())
+			}
+		}
+	}
 	return rs.Set(appKey, info.String(), -1)
 }
 
 const appConfigKeyPattern = "app.cfg.current.%s.%s.%s" // 当前版本
 
-func createDefaultNamespace(appId, group, namespace string) error {
+func createDefaultNamespace(appId, group, namespace, content string) error {
 	nsKey := fmt.Sprintf(appConfigKeyPattern, appId, group, namespace)
 	existed, err := rs.Get(nsKey)
 	if err != nil && !errors.Is(err, badger.ErrKeyNotFound) {
@@ -52,9 +76,7 @@ func createDefaultNamespace(appId, group, namespace string) error {
 		return errors.New("app already exists")
 	}
 	if errors.Is(err, badger.ErrKeyNotFound) {
-		if err := rs.Set(nsKey, "", -1); err != nil {
-			return err
-		}
+		return rs.Set(nsKey, content, -1)
 	}
 	return errors.New("app already exists")
 }
@@ -76,8 +98,11 @@ func modifyAppInfo(info *AppInfo) error {
 	if len(info.Detail) > 0 {
 		app.Detail = info.Detail
 	}
-	if len(info.Groups) > 0 {
-		app.Groups = info.Groups
+	if info.Depends != nil {
+		app.Depends = info.Depends
+	}
+	if info.Labels != nil {
+		app.Labels = info.Labels
 	}
 	appKey := fmt.Sprintf(appInfoPattern, info.AppId)
 	return rs.Set(appKey, app.String(), -1)
@@ -95,76 +120,39 @@ func FindApp(id string) (*AppInfo, error) {
 	return info, nil
 }
 
-func addRole(r role, appId, username string) error {
-	if app, _ := FindApp(appId); app != nil {
-		switch r {
-		case Developer:
-			if contains(app.Developers, username) {
-				return nil
-			} else {
-				if len(app.Developers) == 0 {
-					app.Developers = username
-				} else {
-					app.Developers = app.Developers + "," + username
-				}
-			}
-		case Owner:
-			if contains(app.Owners, username) {
-				return nil
-			} else {
-				if len(app.Owners) == 0 {
-					app.Owners = username
-				} else {
-					app.Owners = app.Owners + "," + username
-				}
-			}
-		case Viewer:
-			if contains(app.Viewers, username) {
-				return nil
-			} else {
-				if len(app.Viewers) == 0 {
-					app.Viewers = username
-				} else {
-					app.Viewers = app.Viewers + "," + username
-				}
-			}
-		default:
-			return errors.New("unknown role")
-		}
-		appKey := fmt.Sprintf(appInfoPattern, appId)
-		return rs.Set(appKey, app.String(), -1)
+// addRole group 为空则授予整个app
+func addRole(r role, appId, group, username string) error {
+	app, _ := FindApp(appId)
+	if app == nil {
+		return errors.New("app not found")
 	}
-	return errors.New("app not found")
+	if len(group) > 0 && !contains(app.Groups, group) {
+		return errors.New("group does not exist")
+	}
+	if err := app.groupRoles(group, true).add(r, username); err != nil {
+		return err
+	}
+	appKey := fmt.Sprintf(appInfoPattern, appId)
+	return rs.Set(appKey, app.String(), -1)
 }
 
-func removeRole(r role, appId, username string) error {
-	if app, _ := FindApp(appId); app != nil {
-		switch r {
-		case Developer:
-			if !contains(app.Developers, username) {
-				return nil
-			} else {
-				app.Developers = removePart(app.Developers, username)
-			}
-		case Owner:
-			if !contains(app.Owners, username) {
-				return nil
-			} else {
-				app.Owners = removePart(app.Owners, username)
-			}
-		case Viewer:
-			if !contains(app.Viewers, username) {
-				return nil
-			} else {
-				app.Viewers = removePart(app.Viewers, username)
-			}
-		default:
-			return errors.New("unknown role")
-		}
-		appKey := fmt.Sprintf(appInfoPattern, appId)
-		return rs.Set(appKey, app.String(), -1)
+func removeRole(r role, appId, group, username string) error {
+	app, _ := FindApp(appId)
+	if app == nil {
+		return errors.New("app does not exist")
 	}
-	return errors.New("app does not exist")
+	roles := app.groupRoles(group, false)
+	if roles == nil {
+		return nil
+	}
+	if err := roles.remove(r, username); err != nil {
+		return err
+	}
+	if len(group) > 0 && roles.empty() {
+		delete(app.Scoped, group)
+	}
+	appKey := fmt.Sprintf(appInfoPattern, appId)
+	return rs.Set(appKey, app.String(), -1)
 }
 
 func removePart(whole, part string) string {
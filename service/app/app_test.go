@@ -1,6 +1,8 @@
 package app
 
 import (
+	"encoding/json"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,3 +15,228 @@ func TestExtract(t *testing.T) {
 	info2 := extractNamespaceInfo(nsStr2)
 	assert.True(t, info2 != nil)
 }
+
+func TestReleaseMatch(t *testing.T) {
+	release := &NamespaceRelease{Release: 12, Checksum: Checksum("a=b")}
+	assert.True(t, release.Match("12"))
+	assert.True(t, release.Match(Checksum("a=b")))
+	assert.False(t, release.Match("11"))
+	assert.False(t, release.Match(""))
+
+	assert.Equal(t, 100, (&Convergence{}).Percent())
+	assert.Equal(t, 50, (&Convergence{Total: 4, Applied: 2}).Percent())
+}
+
+func TestTemplate(t *testing.T) {
+	tpl := &Template{
+		Name:   "web",
+		Groups: []string{"test"},
+		Namespaces: []*TemplateNamespace{
+			{Group: "default", Namespace: "app.props", Content: "name=${appId}\ngroup=${group}"},
+			{Group: "test", Namespace: "app.props", Content: "name=${appId}-${group}"},
+		},
+	}
+	assert.Nil(t, tpl.Valid())
+	assert.Equal(t, []string{"test", "default"}, tpl.AllGroups())
+	assert.Equal(t, "test", tpl.FindNamespace("test", "app.props").Group)
+	assert.Equal(t, "default", tpl.FindNamespace("prod", "app.props").Group)
+	assert.Nil(t, tpl.FindNamespace("default", "db.yaml"))
+
+	ns := tpl.FindNamespace("default", "app.props")
+	assert.Equal(t, "name=demo\ngroup=default", ns.Render(TemplateVars("demo", "default", "app.props")))
+
+	tpl.Namespaces = append(tpl.Namespaces, &TemplateNamespace{Group: "default", Namespace: "app.txt"})
+	assert.NotNil(t, tpl.Valid())
+}
+
+func TestCredentialAllow(t *testing.T) {
+	cred := &Credential{Name: "reader", Scopes: []string{ScopeCfgRead}, CIDRs: []string{"10.0.0.0/8"}}
+	assert.Nil(t, cred.Valid())
+	assert.Nil(t, cred.allow([]string{ScopeCfgRead}, "10.1.2.3"))
+	assert.Nil(t, cred.allow([]string{ScopeSvcRegister, ScopeCfgRead}, "10.1.2.3"))
+	assert.Nil(t, cred.allow(nil, "10.1.2.3"))
+	assert.NotNil(t, cred.allow([]string{ScopeSvcRegister}, "10.1.2.3"))
+	assert.NotNil(t, cred.allow([]string{ScopeCfgRead}, "192.168.1.1"))
+
+	cred.CIDRs = nil
+	cred.Expire = "2000-01-01T00:00:00Z"
+	assert.NotNil(t, cred.allow([]string{ScopeCfgRead}, "192.168.1.1"))
+
+	assert.NotNil(t, (&Credential{Name: "bad", Scopes: []string{"cfg:write"}}).Valid())
+	assert.True(t, HasScope(nil, ScopeSvcRegister))
+	assert.False(t, HasScope([]string{ScopeCfgRead}, ScopeSvcRegister))
+}
+
+func TestGroupRoles(t *testing.T) {
+	info := &AppInfo{AppId: "demo", Groups: "test,prod"}
+	assert.Nil(t, info.groupRoles("", true).add(Owner, "alice"))
+	assert.Nil(t, info.groupRoles("test", true).add(Developer, "bob"))
+	assert.NotNil(t, info.groupRoles("test", true).add(role("admin"), "bob"))
+
+	assert.Nil(t, info.groupRoles("prod", true).add(Viewer, "team:sre"))
+
+	assert.True(t, info.Allowed([]string{"alice"}, Owner, "prod"))
+	assert.True(t, info.Allowed([]string{"bob"}, Developer, "test"))
+	assert.True(t, info.Allowed([]string{"bob"}, Viewer, "test"))
+	assert.False(t, info.Allowed([]string{"bob"}, Developer, "prod"))
+	assert.False(t, info.Allowed([]string{"bob"}, Developer, ""))
+	assert.True(t, info.Allowed([]string{"bob"}, Viewer, ""))
+	assert.True(t, info.Allowed([]string{"carol", "team:sre"}, Viewer, "prod"))
+	assert.False(t, info.Allowed([]string{"carol"}, Viewer, "prod"))
+	assert.ElementsMatch(t, []string{"alice", "bob", "team:sre"}, info.members())
+
+	assert.Nil(t, info.Scoped["test"].remove(Developer, "bob"))
+	assert.True(t, info.Scoped["test"].empty())
+}
+
+func TestMergeApps(t *testing.T) {
+	assert.Equal(t, "a,b,c", mergeApps([]string{"a", "b"}, []string{"b", "c"}, nil))
+	assert.Equal(t, "a", mergeApps([]string{"a", "b", "c"}, nil, []string{"b", "c"}))
+	assert.Equal(t, "", mergeApps(nil, nil, nil))
+}
+
+func TestMergeQuota(t *testing.T) {
+	q := mergeQuota(&builtinQuota, &Quota{Namespaces: 10}, &Quota{Instances: -1}, nil)
+	assert.Equal(t, 10, q.Namespaces)
+	assert.Equal(t, -1, q.Instances)
+	assert.Equal(t, builtinQuota.HistoryDepth, q.HistoryDepth)
+
+	assert.Nil(t, checkLimit("instances", -1, 1000))
+	assert.NotNil(t, checkLimit("namespaces", 10, 10))
+	assert.Nil(t, checkLimit("namespaces", 10, 9))
+}
+
+func TestFilterEdges(t *testing.T) {
+	edges := []*GraphEdge{
+		{From: "a", To: "b", Type: EdgeConfig},
+		{From: "b", To: "c", Type: EdgeDiscover},
+		{From: "d", To: "e", Type: EdgeDeclared},
+	}
+	assert.Len(t, filterEdges(edges, "", 1), 3)
+	assert.Len(t, filterEdges(edges, "a", 1), 1)
+	assert.Len(t, filterEdges(edges, "a", 2), 2)
+	assert.Len(t, filterEdges(edges, "c", 0), 1)
+	assert.Len(t, filterEdges(edges, "x", 3), 0)
+}
+
+func TestSearchApps(t *testing.T) {
+	apps := []*AppInfo{
+		{AppId: "order", Name: "Order Service", Department: "trade", Labels: map[string]string{"env": "prod"}},
+		{AppId: "pay", Name: "Payment", Department: "trade", Roles: Roles{Owners: "alice"}},
+		{AppId: "user", Name: "User Center", Department: "infra", Labels: map[string]string{"env": "prod"}},
+		{AppId: "cart", Name: "Cart", Department: "trade", Scoped: map[string]*Roles{"test": {Owners: "alice"}}},
+	}
+	page := searchApps(apps, &AppQuery{Department: "trade", Size: 2})
+	assert.Equal(t, 3, page.Total)
+	assert.Equal(t, "cart", page.Items[0].AppId)
+	assert.Equal(t, "order", page.Items[1].AppId)
+	assert.NotEmpty(t, page.Next)
+
+	page = searchApps(apps, &AppQuery{Department: "trade", Size: 2, Cursor: page.Next})
+	assert.Len(t, page.Items, 1)
+	assert.Equal(t, "pay", page.Items[0].AppId)
+	assert.Empty(t, page.Next)
+
+	page = searchApps(apps, &AppQuery{Labels: map[string]string{"env": "prod"}, Sort: "-name"})
+	assert.Equal(t, "user", page.Items[0].AppId)
+	assert.Equal(t, 2, page.Total)
+
+	assert.Equal(t, 2, searchApps(apps, &AppQuery{Owner: "alice"}).Total)
+	assert.Equal(t, 1, searchApps(apps, &AppQuery{Name: "PAY"}).Total)
+}
+
+func TestHealthCheck(t *testing.T) {
+	h := &HealthCheck{App: "demo", Group: "default", Type: HealthCheckHTTP, Path: "/health"}
+	assert.Nil(t, h.Valid())
+	h.normalize()
+	assert.Equal(t, defaultCheckInterval, h.Interval)
+	assert.Equal(t, 200, h.Status)
+	assert.NotNil(t, (&HealthCheck{App: "demo", Group: "default", Type: HealthCheckHTTP}).Valid())
+	assert.NotNil(t, (&HealthCheck{App: "demo", Group: "default", Type: "udp"}).Valid())
+	assert.Nil(t, (&HealthCheck{App: "demo", Group: "default", Type: HealthCheckTCP}).Valid())
+
+	s := &healthState{healthy: true}
+	assert.False(t, s.record(false, h))
+	assert.False(t, s.record(false, h))
+	assert.True(t, s.record(false, h))
+	assert.False(t, s.healthy)
+	assert.False(t, s.record(true, h))
+	assert.True(t, s.record(true, h))
+	assert.True(t, s.healthy)
+
+	nodes := []string{"node1", "node2", "node3"}
+	key := "app.instance.info.demo.default.10.0.0.1:8080"
+	assert.Equal(t, assignedNode(key, nodes), assignedNode(key, nodes))
+	assert.Contains(t, nodes, assignedNode(key, nodes))
+	assert.Equal(t, "", assignedNode(key, nil))
+}
+
+func TestNamePattern(t *testing.T) {
+	assert.True(t, namePattern.MatchString("gray-1_a"))
+	assert.False(t, namePattern.MatchString("a.b"))
+	assert.False(t, namePattern.MatchString("a b"))
+	assert.False(t, namePattern.MatchString(""))
+}
+
+func TestAppKeys(t *testing.T) {
+	assert.Error(t, (&AppInfo{AppId: "foo.bar"}).Valid())
+	assert.NoError(t, (&AppInfo{AppId: "foo-bar_1"}).Valid())
+
+	stored := []string{
+		"app.cfg.current.foo.default.app.props",
+		"app.cred.foo.reader",
+		"app.cfg.current.foo-bar.default.app.props",
+		"app.cfg.current.foobar.default.app.props",
+		"app.instance.info.foobar.default.10.0.0.1:8080",
+		"app.cred.foobar.reader",
+	}
+	scan := func(prefix string) []string {
+		keys := make([]string, 0)
+		for _, k := range stored {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	}
+	assert.ElementsMatch(t, []string{"app.cfg.current.foo.default.app.props", "app.cred.foo.reader"}, appKeys("foo", scan))
+}
+
+func TestImpactOf(t *testing.T) {
+	instances := []*NamespaceInstance{{IP: "10.0.0.1", Port: 8080}, {IP: "10.0.0.2", Port: 8080}, {IP: "10.0.0.3", Port: 9090}}
+	owners := map[string]*ServiceInfo{"10.0.0.3:9090": {App: "consumer", Group: "default"}}
+	conns := map[string]*ConnInfo{"demo:10.0.0.1:8080": {Node: "node1"}}
+	impacted := impactOf("demo", "default", instances, owners, func(key string) *ConnInfo { return conns[key] })
+	assert.Len(t, impacted, 3)
+	assert.True(t, impacted[0].Connected)
+	assert.Equal(t, "node1", impacted[0].Node)
+	// 有监听但是连接记录已经删除的， 是断开的实例
+	assert.False(t, impacted[1].Connected)
+	assert.True(t, impacted[2].Shared)
+	assert.Equal(t, "consumer", impacted[2].App)
+	assert.False(t, impacted[2].Connected)
+}
+
+func TestRenameOverrides(t *testing.T) {
+	o := &InstanceOverride{App: "demo", Group: "test", IP: "10.0.0.1", Port: 8080, State: StateDown, Reported: StateUp}
+	renamed := renameOverrides(map[string]string{o.key(): o.String()}, "gray")
+	assert.Len(t, renamed, 1)
+	v, ok := renamed["app.instance.override.demo.gray.10.0.0.1:8080"]
+	assert.True(t, ok)
+	moved := new(InstanceOverride)
+	assert.Nil(t, json.Unmarshal([]byte(v), moved))
+	assert.Equal(t, "gray", moved.Group)
+	assert.Equal(t, StateDown, moved.State)
+	assert.Equal(t, StateUp, moved.Reported)
+}
+
+func TestProbeAllowed(t *testing.T) {
+	assert.True(t, probeAllowed("10.0.0.1"))
+	assert.True(t, probeAllowed("fd00::1"))
+	assert.False(t, probeAllowed("127.0.0.1"))
+	assert.False(t, probeAllowed("::1"))
+	assert.False(t, probeAllowed("169.254.169.254"))
+	assert.False(t, probeAllowed("0.0.0.0"))
+	assert.False(t, probeAllowed("localhost"))
+	assert.Equal(t, errProbeAddr, (&HealthCheck{Type: HealthCheckTCP}).probe("169.254.169.254", 80))
+}
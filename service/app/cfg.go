@@ -1,31 +1,49 @@
 package app
 
 import (
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/winjeg/go-commons/cryptos"
 )
 
 const ClientKeyFormat = "%s:%s:%d"
 
+// 发布信息， 以及实例上报的自己当前持有的发布
+const (
+	releaseKeyPattern  = "app.cfg.release.%s.%s.%s"
+	AppliedPattern     = "app.applied.%s.%s.%s.%s:%d"
+	appliedScanPattern = "app.applied.%s.%s.%s."
+
+	ConvergeApplied = "applied" // 已生效当前发布
+	ConvergeStale   = "stale"   // 持有的是旧的发布
+	ConvergeNever   = "never"   // 从未上报过持有的发布
+)
+
 // 扫描的是待编辑的内容
 // 有待发布的，则看待发布的，没有，则取current
 const namespaceScanPattern = "app.cfg.future.%s.%s."
 const namespaceScanCurrentPattern = "app.cfg.current.%s.%s."
 
 type NamespaceInstance struct {
-	IP        string `json:"ip,omitempty"`
-	Port      int    `json:"port,omitempty"`
-	Namespace string `json:"namespace,omitempty"`
-	Format    string `json:"format"`
+	IP          string `json:"ip,omitempty"`
+	Port        int    `json:"port,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Format      string `json:"format"`
+	Release     string `json:"release,omitempty"`
+	Convergence string `json:"convergence,omitempty"`
 }
 
 type NamespaceInfo struct {
-	Namespace string               `json:"namespace,omitempty"`
-	Format    string               `json:"format,omitempty"`
-	Instances []*NamespaceInstance `json:"instances,omitempty"`
-	Content   string               `json:"content,omitempty"`
-	Original  string               `json:"original,omitempty"`
+	Namespace   string               `json:"namespace,omitempty"`
+	Format      string               `json:"format,omitempty"`
+	Instances   []*NamespaceInstance `json:"instances,omitempty"`
+	Content     string               `json:"content,omitempty"`
+	Original    string               `json:"original,omitempty"`
+	Convergence *Convergence         `json:"convergence,omitempty"`
 }
 
 func GetAllNamespaceInstances(appId, group string) map[string][]*NamespaceInstance {
@@ -67,11 +85,12 @@ func getNamespaces(appId, group string) []*NamespaceInfo {
 			toReleaseContent = v
 		}
 		info := &NamespaceInfo{
-			Namespace: namespace,
-			Format:    namespace[strings.LastIndex(namespace, ".")+1:],
-			Instances: instanceMap[namespace],
-			Content:   toReleaseContent,
-			Original:  v,
+			Namespace:   namespace,
+			Format:      namespace[strings.LastIndex(namespace, ".")+1:],
+			Instances:   instanceMap[namespace],
+			Content:     toReleaseContent,
+			Original:    v,
+			Convergence: namespaceConvergence(appId, group, namespace, instanceMap[namespace]),
 		}
 		result = append(result, info)
 	}
@@ -144,3 +163,90 @@ func extractNamespace(k string) string {
 	}
 	return k[idx2+1:]
 }
+
+// NamespaceRelease 某个namespace 最近一次发布的信息， 发布号单调递增
+type NamespaceRelease struct {
+	Release    int64     `json:"release"`
+	Checksum   string    `json:"checksum,omitempty"`
+	ReleasedBy string    `json:"releasedBy,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+func (r *NamespaceRelease) String() string {
+	d, _ := json.Marshal(r)
+	return string(d)
+}
+
+// Match 实例上报的可以是发布号， 也可以是内容的checksum
+func (r *NamespaceRelease) Match(reported string) bool {
+	if len(reported) == 0 {
+		return false
+	}
+	return reported == strconv.FormatInt(r.Release, 10) || strings.EqualFold(reported, r.Checksum)
+}
+
+// Checksum 配置内容的摘要， 用于客户端与服务端比对所持有的配置是否一致
+func Checksum(content string) string {
+	return cryptos.Sha1([]byte(content))
+}
+
+// FindRelease 获取namespace 当前的发布信息
+// 没有发布记录的（比如还未发布过）则以当前内容生成一个0号发布
+func FindRelease(appId, group, namespace string) *NamespaceRelease {
+	releaseStr, err := rs.Get(fmt.Sprintf(releaseKeyPattern, appId, group, namespace))
+	if err == nil {
+		release := new(NamespaceRelease)
+		if jsonErr := json.Unmarshal([]byte(releaseStr), release); jsonErr == nil {
+			return release
+		}
+	}
+	content, err := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+	if err != nil {
+		return nil
+	}
+	return &NamespaceRelease{Checksum: Checksum(content)}
+}
+
+// Convergence 某次发布在各个监听实例上的生效情况
+type Convergence struct {
+	Release *NamespaceRelease `json:"release,omitempty"`
+	Total   int               `json:"total"`
+	Applied int               `json:"applied"`
+	Stale   int               `json:"stale"`
+	Never   int               `json:"never"`
+}
+
+// Percent 已生效的实例占比， 没有实例监听的视为已全部生效
+func (c *Convergence) Percent() int {
+	if c.Total == 0 {
+		return 100
+	}
+	return c.Applied * 100 / c.Total
+}
+
+// NamespaceConvergence 根据实例心跳上报的发布号，计算当前发布的生效情况
+func NamespaceConvergence(appId, group, namespace string) (*Convergence, []*NamespaceInstance) {
+	instances := GetNamespaceInstances(appId, group, namespace)
+	return namespaceConvergence(appId, group, namespace, instances), instances
+}
+
+func namespaceConvergence(appId, group, namespace string, instances []*NamespaceInstance) *Convergence {
+	release := FindRelease(appId, group, namespace)
+	appliedMap := rs.ScanKvs(fmt.Sprintf(appliedScanPattern, appId, group, namespace))
+	result := &Convergence{Release: release, Total: len(instances)}
+	for _, inst := range instances {
+		inst.Release = appliedMap[fmt.Sprintf(AppliedPattern, appId, group, namespace, inst.IP, inst.Port)]
+		switch {
+		case len(inst.Release) == 0:
+			inst.Convergence = ConvergeNever
+			result.Never++
+		case release != nil && release.Match(inst.Release):
+			inst.Convergence = ConvergeApplied
+			result.Applied++
+		default:
+			inst.Convergence = ConvergeStale
+			result.Stale++
+		}
+	}
+	return result
+}
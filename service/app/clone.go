@@ -0,0 +1,90 @@
+package app
+
+/// 复制一个已有的App， 复制其group以及当前已发布的namespace， 可选复制待发布的配置与角色
+/// 新App 使用新的token， 实例注册信息不复制
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/winjeg/go-commons/str"
+)
+
+type CloneRequest struct {
+	AppId  string `json:"appId"`
+	Name   string `json:"name,omitempty"`
+	Drafts bool   `json:"drafts,omitempty"` // 是否复制待发布的配置
+	Roles  bool   `json:"roles,omitempty"`  // 是否复制角色
+}
+
+func cloneApp(sourceId string, req *CloneRequest, creator string) (*AppInfo, error) {
+	source, _ := FindApp(sourceId)
+	if source == nil {
+		return nil, errors.New("source app does not exist")
+	}
+	info := &AppInfo{
+		AppId:      req.AppId,
+		Name:       req.Name,
+		Creator:    creator,
+		CreateTime: time.Now().Format(time.RFC3339),
+		Token:      str.RandomNumAlphabets(tokenLen),
+		Department: source.Department,
+		Detail:     source.Detail,
+		Groups:     source.Groups,
+	}
+	if err := info.Valid(); err != nil {
+		return nil, err
+	}
+	if app, _ := FindApp(info.AppId); app != nil {
+		return nil, errors.New("app already exist")
+	}
+	if len(info.Name) == 0 {
+		info.Name = source.Name
+	}
+	if req.Roles {
+		info.Roles, info.Scoped = source.Roles, source.Scoped
+	}
+	currents := make(map[string]map[string]string, defaultSize)
+	contents := make([]string, 0, defaultSize)
+	for _, g := range strings.Split(source.Groups, ",") {
+		if len(g) > 0 {
+			currents[g] = rs.ScanKvs(fmt.Sprintf(namespaceScanCurrentPattern, sourceId, g))
+			contents = append(contents, mapValues(currents[g])...)
+		}
+	}
+	if err := checkNewNamespaces(info.AppId, contents); err != nil {
+		return nil, err
+	}
+	for _, g := range strings.Split(source.Groups, ",") {
+		if len(g) == 0 {
+			continue
+		}
+		for k, v := range currents[g] {
+			if err := createDefaultNamespace(info.AppId, g, extractNamespace(k), v); err != nil {
+				return nil, err
+			}
+		}
+		if !req.Drafts {
+			continue
+		}
+		for k, v := range rs.ScanKvs(fmt.Sprintf(namespaceScanPattern, sourceId, g)) {
+			draftKey := fmt.Sprintf(namespaceScanPattern+"%s", info.AppId, g, extractNamespace(k))
+			if err := rs.Set(draftKey, v, -1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := rs.Set(fmt.Sprintf(appInfoPattern, info.AppId), info.String(), -1); err != nil {
+		return nil, err
+	}
+	if req.Roles {
+		for _, u := range info.members() {
+			if err := addUserApp(u, info.AppId); err != nil {
+				logger.Errorln("cloneApp - add user app error: " + err.Error())
+			}
+		}
+	}
+	return info, nil
+}
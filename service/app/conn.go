@@ -0,0 +1,102 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// ConnPattern websocket 连接在哪个节点上， 占位符为客户端连接的key， 即 appId:ip:port
+const (
+	ConnPattern = "app.conn.%s"
+	connExpire  = int64(time.Minute * 2)
+	// ConnRefresh 连接期间重新写入记录的间隔， 小于过期时间
+	ConnRefresh = time.Minute
+)
+
+type ConnInfo struct {
+	Node       string    `json:"node"`
+	Protocol   int       `json:"protocol"`
+	Since      time.Time `json:"since"`
+	Token      string    `json:"token,omitempty"`      // 建立连接时使用的token 指纹
+	Credential string    `json:"credential,omitempty"` // 使用命名凭证连接的， 凭证的名称
+}
+
+func (c *ConnInfo) String() string {
+	d, _ := json.Marshal(c)
+	return string(d)
+}
+
+// SetConn 记录连接所在的节点， 建立连接时写入并定期续期， 断开时删除， 节点宕机的自然过期
+func SetConn(key string, info *ConnInfo) error {
+	return rs.Set(fmt.Sprintf(ConnPattern, key), info.String(), connExpire)
+}
+
+// RemoveConn 连接断开时删除记录， 同一个客户端已经重新连接上来（本节点或者其他节点）的， 保留新的记录
+func RemoveConn(key, node string, since time.Time) error {
+	c := FindConn(key)
+	if c == nil || c.Node != node || !c.Since.Equal(since) {
+		return nil
+	}
+	return rs.Delete(fmt.Sprintf(ConnPattern, key))
+}
+
+func FindConn(key string) *ConnInfo {
+	v, err := rs.Get(fmt.Sprintf(ConnPattern, key))
+	if err != nil {
+		return nil
+	}
+	info := new(ConnInfo)
+	if err := json.Unmarshal([]byte(v), info); err != nil {
+		return nil
+	}
+	return info
+}
+
+// InstanceOwners 按 ip:port 找到实例所属的app与group
+// 共享namespace 的监听key 中只有提供方的app， 需要借此找到真正的使用方
+func InstanceOwners() map[string]*ServiceInfo {
+	keys := rs.ScanKeys(instanceAllScanPattern)
+	result := make(map[string]*ServiceInfo, len(keys))
+	for _, k := range keys {
+		if info := extractAppInfo(k); info != nil {
+			result[fmt.Sprintf("%s:%d", info.IP, info.Port)] = info
+		}
+	}
+	return result
+}
+
+// ImpactedInstance 发布某namespace 会影响到的实例
+type ImpactedInstance struct {
+	App       string `json:"app"`
+	Group     string `json:"group,omitempty"`
+	IP        string `json:"ip"`
+	Port      int    `json:"port"`
+	Shared    bool   `json:"shared"`
+	Connected bool   `json:"connected"`
+	Node      string `json:"node,omitempty"`
+}
+
+// NamespaceImpact 监听了某namespace 的所有实例， 包括以共享方式使用的其他app的实例， 以及其连接所在的节点
+func NamespaceImpact(appId, group, namespace string) []*ImpactedInstance {
+	return impactOf(appId, group, GetNamespaceInstances(appId, group, namespace), InstanceOwners(), FindConn)
+}
+
+// 监听key 由心跳维持， 连接记录在断开时删除， 有监听但是没有连接记录的即是断开的实例
+func impactOf(appId, group string, instances []*NamespaceInstance, owners map[string]*ServiceInfo,
+	findConn func(key string) *ConnInfo) []*ImpactedInstance {
+	result := make([]*ImpactedInstance, 0, len(instances))
+	for _, inst := range instances {
+		impacted := &ImpactedInstance{App: appId, Group: group, IP: inst.IP, Port: inst.Port}
+		if owner, ok := owners[fmt.Sprintf("%s:%d", inst.IP, inst.Port)]; ok {
+			impacted.App, impacted.Group = owner.App, owner.Group
+		}
+		impacted.Shared = impacted.App != appId
+		if c := findConn(fmt.Sprintf(ClientKeyFormat, impacted.App, inst.IP, inst.Port)); c != nil {
+			impacted.Connected = true
+			impacted.Node = c.Node
+		}
+		result = append(result, impacted)
+	}
+	return result
+}
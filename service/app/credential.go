@@ -0,0 +1,149 @@
+package app
+
+/// 一个app 可以有多个命名的凭证， 每个凭证限定可以访问的范围、过期时间以及来源网段
+/// 客户端通过参数 cred 指定使用的凭证， 不指定的使用app 的token， 拥有全部权限
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	credPattern     = "app.cred.%s.%s" // appId, 凭证名称
+	credScanPattern = "app.cred.%s."
+	credParam       = "cred"
+	ScopeCtxKey     = "app.scopes" // 请求上下文中记录的凭证范围， 为空表示全部权限
+
+	ScopeCfgRead     = "cfg:read"
+	ScopeSvcRegister = "svc:register"
+	ScopeSvcDiscover = "svc:discover"
+)
+
+var allScopes = []string{ScopeCfgRead, ScopeSvcRegister, ScopeSvcDiscover}
+
+type Credential struct {
+	Name       string   `json:"name"`
+	Secret     string   `json:"secret,omitempty"`
+	Scopes     []string `json:"scopes"`
+	Expire     string   `json:"expire,omitempty"` // RFC3339， 为空则不过期
+	CIDRs      []string `json:"cidrs,omitempty"`  // 允许的来源网段， 为空则不限制
+	Creator    string   `json:"creator,omitempty"`
+	CreateTime string   `json:"createTime"`
+}
+
+func (c *Credential) Valid() error {
+	if !namePattern.Match([]byte(c.Name)) {
+		return errors.New("credential name illegal")
+	}
+	if len(c.Scopes) == 0 {
+		return errors.New("credential scopes empty")
+	}
+	for _, s := range c.Scopes {
+		if !str.Contains(allScopes, s) {
+			return errors.New("unknown scope: " + s)
+		}
+	}
+	if len(c.Expire) > 0 {
+		if _, err := time.Parse(time.RFC3339, c.Expire); err != nil {
+			return errors.New("expire should be RFC3339 format")
+		}
+	}
+	for _, cidr := range c.CIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return errors.New("illegal cidr: " + cidr)
+		}
+	}
+	return nil
+}
+
+func (c *Credential) String() string {
+	d, _ := json.Marshal(c)
+	return string(d)
+}
+
+// allow 校验凭证是否有其中一个范围、是否过期以及来源IP， scopes 为空只校验后两者
+func (c *Credential) allow(scopes []string, remoteIP string) error {
+	if len(scopes) > 0 && !hasAnyScope(c.Scopes, scopes) {
+		return errors.New("credential requires scope " + strings.Join(scopes, " or "))
+	}
+	if len(c.Expire) > 0 {
+		expire, err := time.Parse(time.RFC3339, c.Expire)
+		if err != nil || time.Now().After(expire) {
+			return errors.New("credential expired")
+		}
+	}
+	if len(c.CIDRs) == 0 {
+		return nil
+	}
+	ip := net.ParseIP(remoteIP)
+	for _, cidr := range c.CIDRs {
+		if _, ipNet, err := net.ParseCIDR(cidr); err == nil && ip != nil && ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return errors.New("source ip not allowed")
+}
+
+func hasAnyScope(owned, required []string) bool {
+	for _, s := range required {
+		if str.Contains(owned, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasScope 上下文中记录的范围是否包含scope， 未记录范围的是app token， 拥有全部权限
+func HasScope(scopes []string, scope string) bool {
+	return scopes == nil || str.Contains(scopes, scope)
+}
+
+func findCredential(appId, name string) (*Credential, error) {
+	v, err := rs.Get(fmt.Sprintf(credPattern, appId, name))
+	if err != nil {
+		return nil, err
+	}
+	c := new(Credential)
+	if err := json.Unmarshal([]byte(v), c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// addCredential 生成新的secret， 同名的凭证会被替换
+func addCredential(appId string, c *Credential) error {
+	if info, _ := FindApp(appId); info == nil {
+		return errors.New("app does not exist")
+	}
+	if err := c.Valid(); err != nil {
+		return err
+	}
+	c.Secret = str.RandomNumAlphabets(tokenLen)
+	c.CreateTime = time.Now().Format(time.RFC3339)
+	return rs.Set(fmt.Sprintf(credPattern, appId, c.Name), c.String(), -1)
+}
+
+func removeCredential(appId, name string) error {
+	return rs.Delete(fmt.Sprintf(credPattern, appId, name))
+}
+
+// 列表中不返回secret， 只在创建时返回一次
+func appCredentials(appId string) []*Credential {
+	kvs := rs.ScanKvs(fmt.Sprintf(credScanPattern, appId))
+	result := make([]*Credential, 0, len(kvs))
+	for _, v := range kvs {
+		c := new(Credential)
+		if err := json.Unmarshal([]byte(v), c); err != nil {
+			continue
+		}
+		c.Secret = ""
+		result = append(result, c)
+	}
+	return result
+}
@@ -21,6 +21,11 @@ const (
 	MetaScanPattern      = "app.instance.meta.%s.%s."
 	NamespaceScanPattern = "app.ns.%s.%s."
 
+	hookPattern        = "app.hook.%s.%s" // appId, hookId
+	hookScanPattern    = "app.hook.%s."
+	hookLogPattern     = "app.hooklog.%s.%s" // appId, 投递时间与hookId
+	hookLogScanPattern = "app.hooklog.%s."
+
 	UserAppPattern  = "user.app.list.%s"
 	UserAppBookMark = "user.app.bookmark.%s"
 
@@ -34,7 +39,8 @@ const (
 	defaultSize = 10
 )
 
-var namePattern, _ = regexp.Compile("[a-zA-Z\\d\\-_]+")
+// appId、group 等名称是key 中以点分隔的一段， 必须整体匹配， 否则按前缀扫描时会波及其他App 的key
+var namePattern = regexp.MustCompile("^[a-zA-Z\\d\\-_]+$")
 
 // AppInfo   the meta info of an app, won't change often
 type AppInfo struct {
@@ -43,12 +49,17 @@ type AppInfo struct {
 	Creator    string `json:"creator,omitempty"`
 	CreateTime string `json:"createTime"`
 	Token      string `json:"token,omitempty"`
-	Department string `json:"department,omitempty"`
-	Detail     string `json:"detail,omitempty"`
-	Owners     string `json:"owners,omitempty"`
-	Developers string `json:"developers,omitempty"`
-	Viewers    string `json:"viewers,omitempty"`
-	Groups     string `json:"groups,omitempty"`
+	// 轮换前的token， 在过期之前仍然有效
+	PrevToken       string `json:"prevToken,omitempty"`
+	PrevTokenExpire string `json:"prevTokenExpire,omitempty"`
+	Department      string `json:"department,omitempty"`
+	Detail          string `json:"detail,omitempty"`
+	Roles
+	Scoped   map[string]*Roles `json:"scoped,omitempty"` // 只授予某个group 的角色
+	Groups   string            `json:"groups,omitempty"`
+	Template string            `json:"template,omitempty"` // 创建时使用的模板
+	Depends  []string          `json:"depends,omitempty"`  // 声明依赖的app
+	Labels   map[string]string `json:"labels,omitempty"`
 }
 
 func (i *AppInfo) Valid() error {
@@ -58,6 +69,16 @@ func (i *AppInfo) Valid() error {
 	return nil
 }
 
+// 去掉token 的副本， 用于审计日志等不应暴露token 的场景
+func (i *AppInfo) masked() *AppInfo {
+	if i == nil {
+		return nil
+	}
+	c := *i
+	c.Token, c.PrevToken = "", ""
+	return &c
+}
+
 func (i *AppInfo) String() string {
 	d, _ := json.Marshal(i)
 	return string(d)
@@ -75,6 +96,12 @@ func (t *EventType) Byte() byte {
 	if strings.EqualFold(string(*t), string(SvcInfoChange)) {
 		return 3
 	}
+	if strings.EqualFold(string(*t), string(ReleaseChange)) {
+		return 4
+	}
+	if strings.EqualFold(string(*t), string(ErrorEvent)) {
+		return 5
+	}
 	return 0
 }
 
@@ -82,9 +109,12 @@ const (
 	ConfigChange  = EventType("cfg")
 	InfoChange    = EventType("info")
 	SvcInfoChange = EventType("svc")
+	ReleaseChange = EventType("release")
+	ErrorEvent    = EventType("error") // 心跳等上行消息被拒绝， 如超出配额
 )
 
 type AppEvent struct {
+	Seq     uint64      `json:"seq,omitempty"`
 	Type    EventType   `json:"type,omitempty"`
 	Content interface{} `json:"content,omitempty"`
 }
@@ -94,3 +124,9 @@ func (e *AppEvent) String() string {
 	d = append(d, e.Type.Byte())
 	return string(d)
 }
+
+// JSON 带序号的完整消息， 用于需要客户端确认的协议
+func (e *AppEvent) JSON() string {
+	d, _ := jsoniter.Marshal(e)
+	return string(d)
+}
@@ -0,0 +1,120 @@
+package app
+
+/// 删除App， 一并清理配置、实例、监听、webhook、凭证以及用户的App 列表与收藏
+/// 有存活实例的需要强制删除， 删除后留下一条记录便于追溯
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	deletedAppPattern = "app.deleted.%s"
+	userAppScanPrefix = "user.app.list."
+	userBookmarkScan  = "user.app.bookmark."
+)
+
+// App 相关的key 前缀， 占位符为appId
+var appScanPatterns = []string{
+	"app.cfg.current.%s.",
+	"app.cfg.future.%s.",
+	"app.cfg.history.%s.",
+	"app.cfg.release.%s.",
+	"app.instance.info.%s.",
+	"app.instance.meta.%s.",
+	overrideScanPattern,
+	healthCheckScanPattern + "%s.",
+	"app.instance.health.%s.",
+	"app.ns.%s.",
+	"app.applied.%s.",
+	"app.conn.%s:",
+	hookScanPattern,
+	hookLogScanPattern,
+	credScanPattern,
+	discoveryScanPattern + "%s.",
+	eventScanPattern + "%s.",
+}
+
+// App 相关的单个key， 占位符为appId
+var appKeyPatterns = []string{lastSeenPattern, quotaPattern}
+
+// DeletedApp 删除App 时留下的记录
+type DeletedApp struct {
+	App        *AppInfo `json:"app"`
+	Operator   string   `json:"operator,omitempty"`
+	Force      bool     `json:"force"`
+	Keys       int      `json:"keys"` // 一共删除的key 数量
+	DeleteTime string   `json:"deleteTime"`
+}
+
+func (d *DeletedApp) String() string {
+	v, _ := json.Marshal(d)
+	return string(v)
+}
+
+// 是否还有存活的实例， 包括注册的服务实例以及监听配置的客户端
+func appAlive(appId string) bool {
+	return len(rs.ScanKeys(fmt.Sprintf("app.instance.info.%s.", appId))) > 0 ||
+		len(rs.ScanKeys(fmt.Sprintf("app.ns.%s.", appId))) > 0
+}
+
+func deleteApp(appId, operator string, force bool) (*DeletedApp, error) {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return nil, errors.New("app does not exist")
+	}
+	if !force && appAlive(appId) {
+		return nil, errors.New("app has alive instances, use force to delete")
+	}
+	// 先删除app 信息， 之后的心跳不会再重新注册实例
+	if err := rs.Delete(fmt.Sprintf(appInfoPattern, appId)); err != nil {
+		return nil, err
+	}
+	count := 1
+	for _, k := range appKeys(appId, rs.ScanKeys) {
+		if err := rs.Delete(k); err != nil {
+			logger.Errorf("deleteApp - delete key %s error: %s\n", k, err.Error())
+			continue
+		}
+		count++
+	}
+	for _, p := range appKeyPatterns {
+		if err := rs.Delete(fmt.Sprintf(p, appId)); err == nil {
+			count++
+		}
+	}
+	removeFromUsers(appId, userAppScanPrefix, UserAppPattern)
+	removeFromUsers(appId, userBookmarkScan, UserAppBookMark)
+
+	record := &DeletedApp{App: info, Operator: operator, Force: force, Keys: count,
+		DeleteTime: time.Now().Format(time.RFC3339)}
+	record.App.Token, record.App.PrevToken = "", ""
+	if err := rs.Set(fmt.Sprintf(deletedAppPattern, appId), record.String(), -1); err != nil {
+		logger.Errorln("deleteApp - save record error: " + err.Error())
+	}
+	return record, nil
+}
+
+// App 相关的所有key， appId 中不允许出现点， 前缀带上分隔符后不会包含其他App 的key
+func appKeys(appId string, scan func(prefix string) []string) []string {
+	keys := make([]string, 0, defaultSize)
+	for _, p := range appScanPatterns {
+		keys = append(keys, scan(fmt.Sprintf(p, appId))...)
+	}
+	return keys
+}
+
+// 从所有用户的App 列表或收藏中移除
+func removeFromUsers(appId, prefix, pattern string) {
+	for k, v := range rs.ScanKvs(prefix) {
+		if !contains(v, appId) {
+			continue
+		}
+		if err := removeApp(strings.TrimPrefix(k, prefix), appId, pattern); err != nil {
+			logger.Errorf("deleteApp - remove app from %s error: %s\n", k, err.Error())
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package app
+
+/// 用户的动态， 包括其有权限或者收藏的app 上的发布、回滚、修改、角色变更、token 轮换以及实例上下线
+/// 事件通过 Notify 记录在 raft 中， 各节点监听事件的写入， 推送给连接在自己上的管理后台
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/gridsx/micro-conf/store/raft"
+	"github.com/gridsx/micro-conf/user"
+	"github.com/gridsx/micro-conf/user/session"
+	"github.com/kataras/iris/v12"
+	"github.com/winjeg/go-commons/str"
+	"github.com/winjeg/irisword/ret"
+)
+
+const (
+	eventPattern     = "app.event.%s.%019d.%s" // appId, 纳秒时间， 事件ID
+	eventScanPattern = "app.event."
+	eventExpire      = int64(time.Hour * 24 * 30) // 动态保留30天
+	feedQueueSize    = 64
+)
+
+var (
+	// 使用默认的同源检查， 避免其他站点借用户的登录态订阅动态
+	feedUpgrade = websocket.Upgrader{}
+	feedLock    sync.RWMutex
+	feedSubs    = make(map[*feedSubscriber]bool, defaultSize)
+)
+
+func init() {
+	rs.Watch(eventScanPattern, onEvent)
+}
+
+func recordEvent(e *HookEvent) {
+	d, _ := json.Marshal(e)
+	key := fmt.Sprintf(eventPattern, e.App, e.Time.UnixNano(), e.Id)
+	if err := rs.Set(key, string(d), eventExpire); err != nil {
+		logger.Errorln("recordEvent - error: " + err.Error())
+	}
+}
+
+type FeedPage struct {
+	Items []*HookEvent `json:"items"`
+	Next  string       `json:"next,omitempty"` // 为空表示没有更早的动态
+}
+
+// 用户有权限以及收藏的app， 收藏的app 需要仍然可以查看
+func feedApps(username string) []string {
+	list := appList(username)
+	apps := make([]string, 0, len(list.Apps)+len(list.Bookmarks))
+	for k := range list.Apps {
+		apps = append(apps, k)
+	}
+	admin, principals := user.IsAdmin(username), user.Principals(username)
+	for k := range list.Bookmarks {
+		if str.Contains(apps, k) {
+			continue
+		}
+		info, _ := FindApp(k)
+		if info == nil || !(admin || info.Allowed(principals, Viewer, "")) {
+			continue
+		}
+		apps = append(apps, k)
+	}
+	return apps
+}
+
+// userFeed 按时间倒序， cursor 为上一页最后一条的时间与ID， events 为空则不过滤事件类型
+func userFeed(apps, events []string, cursor string, size int) *FeedPage {
+	if size <= 0 || size > maxPageSize {
+		size = defaultPageSize
+	}
+	type item struct {
+		sortKey string
+		event   *HookEvent
+	}
+	items := make([]*item, 0, defaultSize)
+	for _, appId := range apps {
+		prefix := eventScanPattern + appId + "."
+		for k, v := range rs.ScanKvs(prefix) {
+			sortKey := strings.TrimPrefix(k, prefix)
+			if len(cursor) > 0 && sortKey >= cursor {
+				continue
+			}
+			e := new(HookEvent)
+			if err := json.Unmarshal([]byte(v), e); err != nil {
+				continue
+			}
+			if len(events) > 0 && !str.Contains(events, e.Event) {
+				continue
+			}
+			items = append(items, &item{sortKey: sortKey, event: e})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].sortKey > items[j].sortKey })
+	page := &FeedPage{Items: make([]*HookEvent, 0, size)}
+	for i, it := range items {
+		if i == size {
+			page.Next = items[i-1].sortKey
+			break
+		}
+		page.Items = append(page.Items, it.event)
+	}
+	return page
+}
+
+func feedEvents(ctx iris.Context) []string {
+	events := make([]string, 0, defaultSize)
+	for _, e := range strings.Split(ctx.URLParam("events"), ",") {
+		if len(e) > 0 {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func getUserFeed(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	if userInfo == nil {
+		ret.Unauthorized(ctx)
+		return
+	}
+	ret.Ok(ctx, userFeed(feedApps(userInfo.Username), feedEvents(ctx), ctx.URLParam("cursor"),
+		ctx.URLParamIntDefault("size", defaultPageSize)))
+}
+
+type feedSubscriber struct {
+	apps   []string
+	events []string
+	send   chan []byte
+}
+
+// 连接时确定关注的app， 之后新增的app 需要重新连接
+func streamUserFeed(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	if userInfo == nil {
+		ret.Unauthorized(ctx)
+		return
+	}
+	conn, err := feedUpgrade.Upgrade(ctx.ResponseWriter(), ctx.Request(), nil)
+	if err != nil {
+		logger.Warnln("streamUserFeed - upgrade err: " + err.Error())
+		return
+	}
+	sub := &feedSubscriber{apps: feedApps(userInfo.Username), events: feedEvents(ctx),
+		send: make(chan []byte, feedQueueSize)}
+	feedLock.Lock()
+	feedSubs[sub] = true
+	feedLock.Unlock()
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	defer func() {
+		feedLock.Lock()
+		delete(feedSubs, sub)
+		feedLock.Unlock()
+		_ = conn.Close()
+	}()
+	for {
+		select {
+		case msg := <-sub.send:
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// 各节点写入事件后， 推送给连接在本节点上关注此app 的用户， 发送不过来的直接丢弃
+func onEvent(op, key, value string) {
+	if op == raft.CmdDel {
+		return
+	}
+	e := new(HookEvent)
+	if err := json.Unmarshal([]byte(value), e); err != nil {
+		return
+	}
+	feedLock.RLock()
+	defer feedLock.RUnlock()
+	for sub := range feedSubs {
+		if !str.Contains(sub.apps, e.App) || (len(sub.events) > 0 && !str.Contains(sub.events, e.Event)) {
+			continue
+		}
+		select {
+		case sub.send <- []byte(value):
+		default:
+		}
+	}
+}
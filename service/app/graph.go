@@ -0,0 +1,155 @@
+package app
+
+/// app 之间的依赖关系图， 用于发布或者下线服务前的影响分析
+/// 1. config: 使用方通过共享namespace 依赖提供方， 来自 app.ns.* 的监听key
+/// 2. discover: 调用 /api/svc/instances 发现服务， 由服务发现接口记录
+/// 3. declared: app 信息中声明的依赖
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EdgeConfig   = "config"
+	EdgeDiscover = "discover"
+	EdgeDeclared = "declared"
+
+	discoveryPattern     = "app.dep.svc.%s.%s" // 调用方， 被发现的app
+	discoveryScanPattern = "app.dep.svc."
+	discoveryExpire      = int64(time.Hour * 24 * 7)
+	discoveryInterval    = time.Hour // 同一对依赖最多每小时记录一次
+	defaultGraphDepth    = 1
+)
+
+var (
+	discoveryLock  sync.Mutex
+	discoverySaved = make(map[string]time.Time, defaultSize)
+)
+
+type GraphNode struct {
+	Id   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+type GraphEdge struct {
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Type  string `json:"type"`
+	Label string `json:"label,omitempty"` // config 为 group/namespace， discover 为 group
+}
+
+type Graph struct {
+	Nodes []*GraphNode `json:"nodes"`
+	Edges []*GraphEdge `json:"edges"`
+}
+
+// RecordDiscovery 记录caller 发现了target 的服务， 一段时间没有再发现的自然过期
+func RecordDiscovery(caller, target, group string) {
+	if len(caller) == 0 || caller == target {
+		return
+	}
+	key := fmt.Sprintf(discoveryPattern, caller, target)
+	discoveryLock.Lock()
+	if time.Since(discoverySaved[key]) < discoveryInterval {
+		discoveryLock.Unlock()
+		return
+	}
+	discoverySaved[key] = time.Now()
+	discoveryLock.Unlock()
+	if err := rs.Set(key, group, discoveryExpire); err != nil {
+		logger.Errorln("RecordDiscovery - error: " + err.Error())
+	}
+}
+
+func allEdges(apps []*AppInfo) []*GraphEdge {
+	edges := make([]*GraphEdge, 0, defaultSize)
+	seen := make(map[string]bool, defaultSize)
+	add := func(e *GraphEdge) {
+		k := e.From + "|" + e.To + "|" + e.Type + "|" + e.Label
+		if e.From == e.To || seen[k] {
+			return
+		}
+		seen[k] = true
+		edges = append(edges, e)
+	}
+
+	// app.ns.提供方.group.namespace.format.ip:port， 按ip:port 找到使用方
+	owners := InstanceOwners()
+	for _, k := range rs.ScanKeys("app.ns.") {
+		arr := strings.SplitN(k, ".", 5)
+		inst := extractNamespaceInfo(k)
+		if len(arr) < 5 || inst == nil {
+			continue
+		}
+		if owner, ok := owners[fmt.Sprintf("%s:%d", inst.IP, inst.Port)]; ok {
+			add(&GraphEdge{From: owner.App, To: arr[2], Type: EdgeConfig, Label: arr[3] + "/" + inst.Namespace})
+		}
+	}
+	for k, v := range rs.ScanKvs(discoveryScanPattern) {
+		arr := strings.SplitN(strings.TrimPrefix(k, discoveryScanPattern), ".", 2)
+		if len(arr) == 2 {
+			add(&GraphEdge{From: arr[0], To: arr[1], Type: EdgeDiscover, Label: v})
+		}
+	}
+	for _, info := range apps {
+		for _, d := range info.Depends {
+			add(&GraphEdge{From: info.AppId, To: d, Type: EdgeDeclared})
+		}
+	}
+	return edges
+}
+
+// filterEdges 只保留与app 相距depth 跳以内的边， 不区分方向
+func filterEdges(edges []*GraphEdge, appId string, depth int) []*GraphEdge {
+	if len(appId) == 0 {
+		return edges
+	}
+	if depth <= 0 {
+		depth = defaultGraphDepth
+	}
+	reached := map[string]bool{appId: true}
+	picked := make(map[*GraphEdge]bool, len(edges))
+	for i := 0; i < depth; i++ {
+		next := make(map[string]bool, len(reached))
+		for _, e := range edges {
+			if reached[e.From] || reached[e.To] {
+				picked[e] = true
+				next[e.From], next[e.To] = true, true
+			}
+		}
+		reached = next
+	}
+	result := make([]*GraphEdge, 0, len(picked))
+	for _, e := range edges {
+		if picked[e] {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
+func dependencyGraph(appId string, depth int) *Graph {
+	apps := allApps()
+	names := make(map[string]string, len(apps))
+	for _, info := range apps {
+		names[info.AppId] = info.Name
+	}
+	edges := filterEdges(allEdges(apps), appId, depth)
+	ids := make(map[string]bool, len(edges))
+	if len(appId) > 0 {
+		ids[appId] = true
+	}
+	for _, e := range edges {
+		ids[e.From], ids[e.To] = true, true
+	}
+	nodes := make([]*GraphNode, 0, len(ids))
+	for id := range ids {
+		nodes = append(nodes, &GraphNode{Id: id, Name: names[id]})
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return &Graph{Nodes: nodes, Edges: edges}
+}
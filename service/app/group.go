@@ -0,0 +1,175 @@
+package app
+
+/// group 的新增、重命名与删除
+/// 有实例注册或者监听的group 不允许重命名与删除， 删除时一并清理其 app.cfg.* 下的配置
+/// 重命名时配置、健康检查、人工设置的实例状态以及group 上的角色一起移动
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/winjeg/go-commons/str"
+)
+
+// group 下的配置相关的key， 依次为当前版本、待发布版本、历史版本以及发布信息
+var groupCfgScanPatterns = []string{
+	"app.cfg.current.%s.%s.",
+	"app.cfg.future.%s.%s.",
+	"app.cfg.history.%s.%s.",
+	"app.cfg.release.%s.%s.",
+}
+
+const (
+	groupAppliedScanPattern  = "app.applied.%s.%s."
+	groupOverrideScanPattern = "app.instance.override.%s.%s."
+)
+
+func appGroups(info *AppInfo) []string {
+	groups := make([]string, 0, defaultSize)
+	for _, g := range strings.Split(info.Groups, ",") {
+		if len(g) > 0 {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// group 下是否还有注册的实例或者监听的客户端
+func groupInUse(appId, group string) bool {
+	return len(rs.ScanKeys(fmt.Sprintf(InstanceScanPattern, appId, group))) > 0 ||
+		len(rs.ScanKeys(fmt.Sprintf(NamespaceScanPattern, appId, group))) > 0
+}
+
+// addGroup 新增group， from 不为空的时候， 复制from 下已发布的namespace
+func addGroup(appId, group, from string) error {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return errors.New("app does not exist")
+	}
+	if !namePattern.MatchString(group) {
+		return errors.New("group name illegal")
+	}
+	groups := appGroups(info)
+	if str.Contains(groups, group) {
+		return errors.New("group already exists")
+	}
+	if len(from) > 0 {
+		if !str.Contains(groups, from) {
+			return errors.New("source group does not exist")
+		}
+		current := rs.ScanKvs(fmt.Sprintf(namespaceScanCurrentPattern, appId, from))
+		if err := checkNewNamespaces(appId, mapValues(current)); err != nil {
+			return err
+		}
+		for k, v := range current {
+			if err := createDefaultNamespace(appId, group, extractNamespace(k), v); err != nil {
+				return err
+			}
+		}
+	}
+	info.Groups = str.Join(append(groups, group), ",")
+	return rs.Set(fmt.Sprintf(appInfoPattern, appId), info.String(), -1)
+}
+
+// renameGroup 先复制配置到新的group， 修改app信息后再删除老的配置
+func renameGroup(appId, group, name string) error {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return errors.New("app does not exist")
+	}
+	if !namePattern.MatchString(name) {
+		return errors.New("group name illegal")
+	}
+	groups := appGroups(info)
+	if !str.Contains(groups, group) {
+		return errors.New("group does not exist")
+	}
+	if str.Contains(groups, name) {
+		return errors.New("group already exists")
+	}
+	if groupInUse(appId, group) {
+		return errors.New("group has registered or listening instances")
+	}
+	for _, p := range groupCfgScanPatterns {
+		oldPrefix, newPrefix := fmt.Sprintf(p, appId, group), fmt.Sprintf(p, appId, name)
+		for k, v := range rs.ScanKvs(oldPrefix) {
+			if err := rs.Set(newPrefix+strings.TrimPrefix(k, oldPrefix), v, -1); err != nil {
+				return err
+			}
+		}
+	}
+	for i := range groups {
+		if groups[i] == group {
+			groups[i] = name
+		}
+	}
+	if h := FindHealthCheck(appId, group); h != nil {
+		h.Group = name
+		if err := rs.Set(fmt.Sprintf(healthCheckPattern, appId, name), h.String(), -1); err != nil {
+			return err
+		}
+		h.normalize()
+		oldPrefix, newPrefix := fmt.Sprintf(healthResultScanPattern, appId, group), fmt.Sprintf(healthResultScanPattern, appId, name)
+		expire := int64(time.Duration(h.Interval*healthResultExpireRate) * time.Second)
+		for k, v := range rs.ScanKvs(oldPrefix) {
+			if err := rs.Set(newPrefix+strings.TrimPrefix(k, oldPrefix), v, expire); err != nil {
+				return err
+			}
+		}
+	}
+	// 人工设置的状态随group 一起移动， 否则被摘除的实例重命名后会重新接收流量
+	for k, v := range renameOverrides(rs.ScanKvs(fmt.Sprintf(groupOverrideScanPattern, appId, group)), name) {
+		if err := rs.Set(k, v, -1); err != nil {
+			return err
+		}
+	}
+	info.Groups = str.Join(groups, ",")
+	if roles, ok := info.Scoped[group]; ok {
+		info.Scoped[name] = roles
+		delete(info.Scoped, group)
+	}
+	if err := rs.Set(fmt.Sprintf(appInfoPattern, appId), info.String(), -1); err != nil {
+		return err
+	}
+	return cleanGroup(appId, group)
+}
+
+func removeGroup(appId, group string) error {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return errors.New("app does not exist")
+	}
+	groups := appGroups(info)
+	if !str.Contains(groups, group) {
+		return errors.New("group does not exist")
+	}
+	if len(groups) == 1 {
+		return errors.New("can not remove the last group")
+	}
+	if groupInUse(appId, group) {
+		return errors.New("group has registered or listening instances")
+	}
+	info.Groups = removePart(info.Groups, group)
+	delete(info.Scoped, group)
+	if err := rs.Set(fmt.Sprintf(appInfoPattern, appId), info.String(), -1); err != nil {
+		return err
+	}
+	return cleanGroup(appId, group)
+}
+
+// 清理group 下的配置以及残留的实例元信息、人工设置的状态与健康检查
+func cleanGroup(appId, group string) error {
+	patterns := make([]string, 0, len(groupCfgScanPatterns)+3)
+	patterns = append(patterns, groupCfgScanPatterns...)
+	patterns = append(patterns, groupAppliedScanPattern, groupOverrideScanPattern, MetaScanPattern)
+	for _, p := range patterns {
+		for _, k := range rs.ScanKeys(fmt.Sprintf(p, appId, group)) {
+			if err := rs.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+	return removeHealthCheck(appId, group)
+}
@@ -0,0 +1,392 @@
+package app
+
+/// 服务端对注册实例的主动健康检查， 弥补心跳线程存活但是服务端口已经不可用的情况
+/// 按实例key 的哈希分配给集群中存活的节点执行， 只有不健康的实例会写入检查结果
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gridsx/micro-conf/config"
+	raftStore "github.com/gridsx/micro-conf/store/raft"
+)
+
+const (
+	healthCheckPattern      = "app.health.check.%s.%s" // appId, group
+	healthCheckScanPattern  = "app.health.check."
+	healthResultPattern     = "app.instance.health.%s.%s.%s:%d"
+	healthResultScanPattern = "app.instance.health.%s.%s."
+	healthNodePattern       = "app.health.node.%s" // 节点存活的记录， 带过期时间
+
+	HealthCheckHTTP = "http"
+	HealthCheckTCP  = "tcp"
+
+	HealthHealthy   = "HEALTHY"
+	HealthUnhealthy = "UNHEALTHY"
+
+	healthTickInterval     = time.Second
+	defaultCheckInterval   = 10
+	defaultCheckTimeout    = 2
+	defaultHealthyCount    = 2
+	defaultUnhealthyCount  = 3
+	minCheckInterval       = 1
+	healthResultExpireRate = 3 // 检查结果的有效期为检查间隔的倍数， 检查节点变化后过期的结果自动消失
+	healthNodeInterval     = 5 * time.Second
+	healthNodeExpire       = 3 * healthNodeInterval
+)
+
+// HealthCheck 服务的健康检查定义， 间隔与超时的单位为秒
+type HealthCheck struct {
+	App       string `json:"app"`
+	Group     string `json:"group"`
+	Type      string `json:"type"`             // http 或者 tcp
+	Path      string `json:"path,omitempty"`   // http 检查的路径
+	Status    int    `json:"status,omitempty"` // http 检查期望的状态码， 默认200
+	Interval  int    `json:"interval,omitempty"`
+	Timeout   int    `json:"timeout,omitempty"`
+	Healthy   int    `json:"healthy,omitempty"`   // 连续成功多少次恢复为健康
+	Unhealthy int    `json:"unhealthy,omitempty"` // 连续失败多少次标记为不健康
+}
+
+func (h *HealthCheck) Valid() error {
+	if len(h.App) == 0 || len(h.Group) == 0 {
+		return errors.New("app and group required")
+	}
+	switch h.Type {
+	case HealthCheckHTTP:
+		if !strings.HasPrefix(h.Path, "/") {
+			return errors.New("http check path must start with /")
+		}
+	case HealthCheckTCP:
+	default:
+		return errors.New("check type must be http or tcp")
+	}
+	if h.Interval != 0 && h.Interval < minCheckInterval {
+		return errors.New("interval too small")
+	}
+	if h.Timeout < 0 || h.Healthy < 0 || h.Unhealthy < 0 {
+		return errors.New("timeout and thresholds must not be negative")
+	}
+	return nil
+}
+
+// 未设置的字段使用默认值， 超时不能超过间隔
+func (h *HealthCheck) normalize() {
+	if h.Interval == 0 {
+		h.Interval = defaultCheckInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = defaultCheckTimeout
+	}
+	if h.Timeout > h.Interval {
+		h.Timeout = h.Interval
+	}
+	if h.Healthy == 0 {
+		h.Healthy = defaultHealthyCount
+	}
+	if h.Unhealthy == 0 {
+		h.Unhealthy = defaultUnhealthyCount
+	}
+	if h.Type == HealthCheckHTTP && h.Status == 0 {
+		h.Status = http.StatusOK
+	}
+}
+
+func (h *HealthCheck) String() string {
+	d, _ := json.Marshal(h)
+	return string(d)
+}
+
+var (
+	errProbeAddr    = errors.New("address not allowed")
+	errProbeTimeout = errors.New("timeout")
+	errProbeConnect = errors.New("connection failed")
+)
+
+// 实例的地址是自己上报的， 不探测本机、链路本地等地址， 避免借健康检查访问节点自身或者云上的元数据服务
+func probeAllowed(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && !addr.IsLoopback() && !addr.IsUnspecified() &&
+		!addr.IsLinkLocalUnicast() && !addr.IsLinkLocalMulticast() && !addr.IsMulticast()
+}
+
+// 结果中只记录错误的类别， 不返回原始的错误信息
+func probeError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return errProbeTimeout
+	}
+	return errProbeConnect
+}
+
+func (h *HealthCheck) probe(ip string, port int) error {
+	if !probeAllowed(ip) {
+		return errProbeAddr
+	}
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	timeout := time.Duration(h.Timeout) * time.Second
+	if h.Type == HealthCheckTCP {
+		c, err := net.DialTimeout("tcp", addr, timeout)
+		if err != nil {
+			return probeError(err)
+		}
+		_ = c.Close()
+		return nil
+	}
+	// 不跟随重定向， 以实例自己的响应为准
+	client := &http.Client{Timeout: timeout, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get("http://" + addr + h.Path)
+	if err != nil {
+		return probeError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != h.Status {
+		return fmt.Errorf("status %d, expected %d", resp.StatusCode, h.Status)
+	}
+	return nil
+}
+
+// HealthResult 不健康实例的检查结果
+type HealthResult struct {
+	Failures int    `json:"failures"`
+	Error    string `json:"error,omitempty"`
+	Node     string `json:"node"`
+	Checked  string `json:"checked"`
+}
+
+func FindHealthCheck(appId, group string) *HealthCheck {
+	v, err := rs.Get(fmt.Sprintf(healthCheckPattern, appId, group))
+	if err != nil {
+		return nil
+	}
+	h := new(HealthCheck)
+	if err := json.Unmarshal([]byte(v), h); err != nil {
+		return nil
+	}
+	return h
+}
+
+func saveHealthCheck(h *HealthCheck) error {
+	if err := h.Valid(); err != nil {
+		return err
+	}
+	info, _ := FindApp(h.App)
+	if info == nil {
+		return errors.New("app does not exist")
+	}
+	if !contains(info.Groups, h.Group) {
+		return errors.New("group does not exist")
+	}
+	h.normalize()
+	return rs.Set(fmt.Sprintf(healthCheckPattern, h.App, h.Group), h.String(), -1)
+}
+
+// 删除定义的同时清掉已有的结果
+func removeHealthCheck(appId, group string) error {
+	if err := rs.Delete(fmt.Sprintf(healthCheckPattern, appId, group)); err != nil {
+		return err
+	}
+	for _, k := range rs.ScanKeys(fmt.Sprintf(healthResultScanPattern, appId, group)) {
+		if err := rs.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func appHealthChecks(appId string) []*HealthCheck {
+	kvs := rs.ScanKvs(healthCheckScanPattern + appId + ".")
+	result := make([]*HealthCheck, 0, len(kvs))
+	for _, v := range kvs {
+		h := new(HealthCheck)
+		if err := json.Unmarshal([]byte(v), h); err == nil {
+			result = append(result, h)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Group < result[j].Group })
+	return result
+}
+
+// 不健康实例的检查结果， key 为 ip:port
+func unhealthyInstances(appId, group string) map[string]*HealthResult {
+	prefix := fmt.Sprintf(healthResultScanPattern, appId, group)
+	kvs := rs.ScanKvs(prefix)
+	result := make(map[string]*HealthResult, len(kvs))
+	for k, v := range kvs {
+		r := new(HealthResult)
+		if err := json.Unmarshal([]byte(v), r); err == nil {
+			result[strings.TrimPrefix(k, prefix)] = r
+		}
+	}
+	return result
+}
+
+// 按实例key 的哈希在节点中选出负责检查的节点
+func assignedNode(key string, nodes []string) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return nodes[h.Sum32()%uint32(len(nodes))]
+}
+
+// 本节点上每个实例的连续成功、失败次数
+type healthState struct {
+	healthy   bool
+	successes int
+	failures  int
+	next      time.Time
+	running   bool
+}
+
+// record 记录一次检查结果， 健康状态发生变化时返回true
+func (s *healthState) record(ok bool, h *HealthCheck) bool {
+	if ok {
+		s.failures = 0
+		s.successes++
+		if !s.healthy && s.successes >= h.Healthy {
+			s.healthy = true
+			return true
+		}
+		return false
+	}
+	s.successes = 0
+	s.failures++
+	if s.healthy && s.failures >= h.Unhealthy {
+		s.healthy = false
+		return true
+	}
+	return false
+}
+
+var (
+	healthStates = make(map[string]*healthState, defaultSize)
+	healthLock   sync.Mutex
+)
+
+func init() {
+	go runHealthChecks()
+	go reportHealthNode()
+}
+
+// 定期写入本节点的存活记录， 写入经过leader， 与leader 失联的节点记录会过期， 其负责的实例由其他节点接手
+func reportHealthNode() {
+	ticker := time.NewTicker(healthNodeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		key := fmt.Sprintf(healthNodePattern, config.App.Raft.PeerId)
+		if err := rs.Set(key, time.Now().Format(time.RFC3339), int64(healthNodeExpire)); err != nil {
+			logger.Warnf("healthCheck - report node alive err: %s\n", err.Error())
+		}
+	}
+}
+
+func runHealthChecks() {
+	ticker := time.NewTicker(healthTickInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		scheduleHealthChecks()
+	}
+}
+
+// 集群中存活记录还没有过期的节点， 只在这些节点间分配， 避免实例分配给了已经失联的节点而没有人检查
+func liveNodes() []string {
+	info := raftStore.NewClusterInfo(rs.Raft())
+	nodes := make([]string, 0, len(info.Peers))
+	for _, p := range info.Peers {
+		if _, err := rs.Get(fmt.Sprintf(healthNodePattern, p.Id)); err == nil {
+			nodes = append(nodes, p.Id)
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func scheduleHealthChecks() {
+	nodes := liveNodes()
+	self := config.App.Raft.PeerId
+	seen := make(map[string]bool, defaultSize)
+	for _, v := range rs.ScanKvs(healthCheckScanPattern) {
+		h := new(HealthCheck)
+		if err := json.Unmarshal([]byte(v), h); err != nil {
+			continue
+		}
+		h.normalize()
+		for instKey, state := range rs.ScanKvs(fmt.Sprintf(InstanceScanPattern, h.App, h.Group)) {
+			// 只检查在线的实例， 下线的本来就不会被路由
+			if state != StateUp || assignedNode(instKey, nodes) != self {
+				continue
+			}
+			seen[instKey] = true
+			scheduleHealthCheck(instKey, h)
+		}
+	}
+	// 实例下线或者分配给了其他节点的， 不再保留状态
+	healthLock.Lock()
+	for k := range healthStates {
+		if !seen[k] {
+			delete(healthStates, k)
+		}
+	}
+	healthLock.Unlock()
+}
+
+func scheduleHealthCheck(instKey string, h *HealthCheck) {
+	info := extractAppInfo(instKey)
+	if info == nil {
+		return
+	}
+	resultKey := fmt.Sprintf(healthResultPattern, info.App, info.Group, info.IP, info.Port)
+	healthLock.Lock()
+	defer healthLock.Unlock()
+	s, ok := healthStates[instKey]
+	if !ok {
+		// 刚分配到本节点的， 沿用之前节点的检查结果
+		_, err := rs.Get(resultKey)
+		s = &healthState{healthy: err != nil}
+		healthStates[instKey] = s
+	}
+	if s.running || time.Now().Before(s.next) {
+		return
+	}
+	s.running = true
+	s.next = time.Now().Add(time.Duration(h.Interval) * time.Second)
+	go func() {
+		err := h.probe(info.IP, info.Port)
+		healthLock.Lock()
+		s.running = false
+		changed := s.record(err == nil, h)
+		healthy, failures := s.healthy, s.failures
+		healthLock.Unlock()
+		if healthy {
+			if changed {
+				if delErr := rs.Delete(resultKey); delErr != nil {
+					logger.Errorf("healthCheck - clear result %s err: %s\n", resultKey, delErr.Error())
+				}
+			}
+			return
+		}
+		// 不健康的每次检查都刷新结果， 避免过期
+		result := &HealthResult{Failures: failures, Node: config.App.Raft.PeerId, Checked: time.Now().Format(time.RFC3339)}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		d, _ := json.Marshal(result)
+		expire := int64(time.Duration(h.Interval*healthResultExpireRate) * time.Second)
+		if setErr := rs.Set(resultKey, string(d), expire); setErr != nil {
+			logger.Errorf("healthCheck - set result %s err: %s\n", resultKey, setErr.Error())
+		}
+	}()
+}
@@ -0,0 +1,199 @@
+package app
+
+/// 应用的webhook， Owner 可以给应用注册多个HTTP地址， 在发布、回滚、修改待发布配置以及实例上下线时收到通知
+/// 通知按照 api/signer.go 的规则用应用的token签名， 接收方可以用 api.CheckValid 校验， 并比对 digest 与请求体的sha256
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gridsx/micro-conf/api"
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	HookRelease      = "namespace.release"
+	HookDraft        = "namespace.draft"
+	HookInstanceUp   = "instance.up"
+	HookInstanceDown = "instance.down"
+	HookRoleChange   = "role.change"
+	HookTokenRotate  = "token.rotate"
+
+	hookIdLen        = 8
+	maxHookAttempts  = 5                         // 最多投递次数
+	hookRetryBackoff = time.Second * 2           // 重试的间隔， 每次翻倍
+	hookLogExpire    = int64(time.Hour * 24 * 7) // 投递日志保留7天
+)
+
+// Webhook 应用注册的通知地址， Events 为空的接收所有事件
+type Webhook struct {
+	Id         string   `json:"id,omitempty"`
+	Url        string   `json:"url,omitempty"`
+	Events     []string `json:"events,omitempty"`
+	Creator    string   `json:"creator,omitempty"`
+	CreateTime string   `json:"createTime"`
+}
+
+func (h *Webhook) Valid() error {
+	u, err := url.Parse(h.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return errors.New("webhook url illegal")
+	}
+	return nil
+}
+
+func (h *Webhook) accept(event string) bool {
+	return len(h.Events) == 0 || str.Contains(h.Events, event)
+}
+
+func (h *Webhook) String() string {
+	d, _ := json.Marshal(h)
+	return string(d)
+}
+
+// HookEvent 推送给webhook的请求体
+type HookEvent struct {
+	Id    string      `json:"id"`
+	App   string      `json:"app"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// HookDelivery 每一次投递的记录
+type HookDelivery struct {
+	EventId string    `json:"eventId"`
+	HookId  string    `json:"hookId"`
+	Url     string    `json:"url"`
+	Event   string    `json:"event"`
+	Attempt int       `json:"attempt"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+func addHook(appId string, hook *Webhook) error {
+	if err := hook.Valid(); err != nil {
+		return err
+	}
+	if app, _ := FindApp(appId); app == nil {
+		return errors.New("app does not exist")
+	}
+	hook.Id = str.RandomNumAlphabets(hookIdLen)
+	hook.CreateTime = time.Now().Format(time.RFC3339)
+	return rs.Set(fmt.Sprintf(hookPattern, appId, hook.Id), hook.String(), -1)
+}
+
+func removeHook(appId, hookId string) error {
+	if len(hookId) == 0 {
+		return errors.New("hook id is empty")
+	}
+	return rs.Delete(fmt.Sprintf(hookPattern, appId, hookId))
+}
+
+func appHooks(appId string) []*Webhook {
+	hookMap := rs.ScanKvs(fmt.Sprintf(hookScanPattern, appId))
+	hooks := make([]*Webhook, 0, len(hookMap))
+	for _, v := range hookMap {
+		hook := new(Webhook)
+		if err := json.Unmarshal([]byte(v), hook); err != nil {
+			continue
+		}
+		hooks = append(hooks, hook)
+	}
+	return hooks
+}
+
+// 最近的投递记录， 按时间倒序
+func hookDeliveries(appId string) []*HookDelivery {
+	logMap := rs.ScanKvs(fmt.Sprintf(hookLogScanPattern, appId))
+	logs := make([]*HookDelivery, 0, len(logMap))
+	for _, v := range logMap {
+		d := new(HookDelivery)
+		if err := json.Unmarshal([]byte(v), d); err != nil {
+			continue
+		}
+		logs = append(logs, d)
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].Time.After(logs[j].Time) })
+	return logs
+}
+
+// Notify 记录到应用的动态中， 并给应用注册的webhook 异步发送通知， 失败的按退避策略重试
+func Notify(appId, event string, data interface{}) {
+	e := &HookEvent{
+		Id:    str.RandomNumAlphabets(tokenLen),
+		App:   appId,
+		Event: event,
+		Time:  time.Now(),
+		Data:  data,
+	}
+	recordEvent(e)
+	hooks := appHooks(appId)
+	if len(hooks) == 0 {
+		return
+	}
+	app, err := FindApp(appId)
+	if err != nil || app == nil {
+		return
+	}
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.Errorln("Notify - json err: " + err.Error())
+		return
+	}
+	for _, h := range hooks {
+		if h.accept(event) {
+			go deliverHook(app, h, e, string(body))
+		}
+	}
+}
+
+func deliverHook(app *AppInfo, hook *Webhook, e *HookEvent, body string) {
+	client := api.DefaultClient(app.AppId, app.Token)
+	// 请求体的摘要作为参数参与签名， 防止请求体被篡改
+	digest := fmt.Sprintf("%x", sha256.Sum256([]byte(body)))
+	sep := "?"
+	if strings.Contains(hook.Url, "?") {
+		sep = "&"
+	}
+	hookUrl := fmt.Sprintf("%s%sevent=%s&digest=%s", hook.Url, sep, e.Event, digest)
+	backoff := hookRetryBackoff
+	for i := 1; i <= maxHookAttempts; i++ {
+		_, err := client.Post(hookUrl, body, http.Header{})
+		delivery := &HookDelivery{
+			EventId: e.Id,
+			HookId:  hook.Id,
+			Url:     hook.Url,
+			Event:   e.Event,
+			Attempt: i,
+			Success: err == nil,
+			Time:    time.Now(),
+		}
+		if err != nil {
+			delivery.Error = err.Error()
+		}
+		logHookDelivery(app.AppId, delivery)
+		if err == nil {
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	logger.Warnf("deliverHook - app %s hook %s event %s failed after %d attempts\n", app.AppId, hook.Id, e.Event, maxHookAttempts)
+}
+
+func logHookDelivery(appId string, d *HookDelivery) {
+	data, _ := json.Marshal(d)
+	key := fmt.Sprintf(hookLogPattern, appId, d.Time.Format(time.RFC3339Nano)+"."+d.HookId)
+	if err := rs.Set(key, string(data), hookLogExpire); err != nil {
+		logger.Errorln("logHookDelivery - set log err: " + err.Error())
+	}
+}
@@ -0,0 +1,60 @@
+package app
+
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	instanceScanInterval   = time.Second * 10
+	instanceAllScanPattern = "app.instance.info."
+)
+
+// 上次扫描到的实例状态， 心跳超时的实例key 会过期消失， 只能通过定时扫描比对发现
+var instanceStates map[string]string
+
+func init() {
+	go watchInstances()
+}
+
+// InstanceStateChanged 实例状态发生变化时调用， 上线或者下线的发送通知
+func InstanceStateChanged(appId, group, ip string, port int, before, after string) {
+	if before == after {
+		return
+	}
+	info := &ServiceInfo{App: appId, Group: group, IP: ip, Port: port, State: after}
+	switch {
+	case after == StateUp:
+		Notify(appId, HookInstanceUp, info)
+	case before == StateUp:
+		Notify(appId, HookInstanceDown, info)
+	}
+}
+
+func watchInstances() {
+	ticker := time.NewTicker(instanceScanInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		scanInstances()
+	}
+}
+
+// 只有leader 负责发现过期下线的实例， 避免重复通知
+func scanInstances() {
+	if rs.Raft().State() != raft.Leader {
+		instanceStates = nil
+		return
+	}
+	current := rs.ScanKvs(instanceAllScanPattern)
+	for k, v := range instanceStates {
+		if _, ok := current[k]; ok {
+			continue
+		}
+		if info := extractAppInfo(k); info != nil {
+			InstanceStateChanged(info.App, info.Group, info.IP, info.Port, v, "")
+		}
+	}
+	instanceStates = current
+	recordLastSeen(current)
+}
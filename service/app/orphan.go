@@ -0,0 +1,180 @@
+package app
+
+/// 孤儿app 报告与所有权转移
+/// Owner 离职后app 可能没有可用的Owner， 或者长期没有实例， 需要管理员发现并转移给他人
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gridsx/micro-conf/user"
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	lastSeenPattern   = "app.lastseen.%s" // app 最近一次有实例的时间
+	lastSeenInterval  = time.Hour         // 最近有实例的时间最多每小时记录一次
+	defaultOrphanDays = 30
+)
+
+// 本节点上次记录的时间， 只有leader 记录
+var lastSeenSaved = make(map[string]time.Time, defaultSize)
+
+// 由leader 在扫描实例时调用
+func recordLastSeen(instances map[string]string) {
+	now := time.Now()
+	for k := range instances {
+		info := extractAppInfo(k)
+		if info == nil || now.Sub(lastSeenSaved[info.App]) < lastSeenInterval {
+			continue
+		}
+		if err := rs.Set(fmt.Sprintf(lastSeenPattern, info.App), now.Format(time.RFC3339), -1); err != nil {
+			logger.Errorln("recordLastSeen - error: " + err.Error())
+			continue
+		}
+		lastSeenSaved[info.App] = now
+	}
+}
+
+type OrphanApp struct {
+	AppId          string   `json:"appId"`
+	Name           string   `json:"name,omitempty"`
+	Owners         []string `json:"owners"`
+	MissingOwners  []string `json:"missingOwners,omitempty"`  // 已经不存在的用户或者没有成员的团队
+	DisabledOwners []string `json:"disabledOwners,omitempty"` // 被管理员禁用的用户
+	NoOwner        bool     `json:"noOwner"`                  // 没有可用的Owner， 无人可以发布
+	Idle           bool     `json:"idle"`                     // 超过指定天数没有实例
+	LastSeen       string   `json:"lastSeen,omitempty"`
+}
+
+// orphanApps 没有可用Owner 或者超过days 天没有实例的app
+func orphanApps(days int) []*OrphanApp {
+	if days <= 0 {
+		days = defaultOrphanDays
+	}
+	deadline := time.Now().Add(-time.Hour * 24 * time.Duration(days))
+	result := make([]*OrphanApp, 0, defaultSize)
+	for _, info := range allApps() {
+		orphan := &OrphanApp{AppId: info.AppId, Name: info.Name, Owners: splitUsers(info.Owners)}
+		for _, o := range orphan.Owners {
+			if !user.PrincipalExists(o) {
+				orphan.MissingOwners = append(orphan.MissingOwners, o)
+			} else if user.Disabled(o) {
+				orphan.DisabledOwners = append(orphan.DisabledOwners, o)
+			}
+		}
+		orphan.NoOwner = len(orphan.Owners) == len(orphan.MissingOwners)+len(orphan.DisabledOwners)
+		orphan.LastSeen, _ = rs.Get(fmt.Sprintf(lastSeenPattern, info.AppId))
+		if len(rs.ScanKeys(fmt.Sprintf("app.instance.info.%s.", info.AppId))) == 0 {
+			since := orphan.LastSeen
+			if len(since) == 0 {
+				since = info.CreateTime
+			}
+			t, err := time.Parse(time.RFC3339, since)
+			orphan.Idle = err == nil && t.Before(deadline)
+		}
+		if orphan.NoOwner || orphan.Idle {
+			result = append(result, orphan)
+		}
+	}
+	return result
+}
+
+func allApps() []*AppInfo {
+	kvs := rs.ScanKvs(appInfoScanPattern)
+	result := make([]*AppInfo, 0, len(kvs))
+	for _, v := range kvs {
+		info := new(AppInfo)
+		if err := json.Unmarshal([]byte(v), info); err != nil {
+			continue
+		}
+		result = append(result, info)
+	}
+	return result
+}
+
+func splitUsers(users string) []string {
+	result := make([]string, 0, defaultSize)
+	for _, u := range strings.Split(users, ",") {
+		if len(u) > 0 {
+			result = append(result, u)
+		}
+	}
+	return result
+}
+
+type TransferRequest struct {
+	From string   `json:"from"`
+	To   string   `json:"to"`             // 用户或者团队（team:名称）
+	Apps []string `json:"apps,omitempty"` // 为空则转移 from 作为Owner 的所有app
+}
+
+// transferOwnership 把 from 在app 以及各group 上的Owner 角色转给 to，
+// app 信息与双方的app 列表在同一个raft 日志中修改
+func transferOwnership(req *TransferRequest) ([]string, error) {
+	if len(req.From) == 0 || req.From == req.To {
+		return nil, errors.New("illegal transfer")
+	}
+	if !user.PrincipalExists(req.To) || user.Disabled(req.To) {
+		return nil, errors.New("target user does not exist or disabled")
+	}
+	kvs := make(map[string]string, defaultSize)
+	transferred := make([]string, 0, defaultSize)
+	left := make([]string, 0, defaultSize) // from 不再有任何角色的app， 需要从其app 列表中移除
+	for _, info := range allApps() {
+		if len(req.Apps) > 0 && !str.Contains(req.Apps, info.AppId) {
+			continue
+		}
+		changed := false
+		for _, roles := range append([]*Roles{&info.Roles}, scopedRoles(info)...) {
+			if !contains(roles.Owners, req.From) {
+				continue
+			}
+			roles.Owners = removePart(roles.Owners, req.From)
+			_ = roles.add(Owner, req.To)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+		kvs[fmt.Sprintf(appInfoPattern, info.AppId)] = info.String()
+		transferred = append(transferred, info.AppId)
+		if !str.Contains(info.members(), req.From) {
+			left = append(left, info.AppId)
+		}
+	}
+	if len(transferred) == 0 {
+		return transferred, nil
+	}
+	kvs[fmt.Sprintf(UserAppPattern, req.To)] = mergeApps(userAppIds(req.To), transferred, nil)
+	if len(left) > 0 {
+		kvs[fmt.Sprintf(UserAppPattern, req.From)] = mergeApps(userAppIds(req.From), nil, left)
+	}
+	return transferred, rs.SetBatch(kvs)
+}
+
+func scopedRoles(info *AppInfo) []*Roles {
+	result := make([]*Roles, 0, len(info.Scoped))
+	for _, roles := range info.Scoped {
+		result = append(result, roles)
+	}
+	return result
+}
+
+func userAppIds(principal string) []string {
+	v, _ := rs.Get(fmt.Sprintf(UserAppPattern, principal))
+	return splitUsers(v)
+}
+
+func mergeApps(apps, added, removed []string) string {
+	result := make([]string, 0, len(apps)+len(added))
+	for _, a := range append(apps, added...) {
+		if !str.Contains(result, a) && !str.Contains(removed, a) {
+			result = append(result, a)
+		}
+	}
+	return str.Join(result, ",")
+}
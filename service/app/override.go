@@ -0,0 +1,145 @@
+package app
+
+/// 人工设置实例的状态， 用于排查问题或者发布时摘除流量
+/// 设置后实例的心跳与重新注册都不会改变其状态， 直到人工解除， 解除后恢复实例自己上报的状态
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	overridePattern     = "app.instance.override.%s.%s.%s:%d"
+	overrideScanPattern = "app.instance.override.%s."
+)
+
+type InstanceOverride struct {
+	App      string `json:"app"`
+	Group    string `json:"group"`
+	IP       string `json:"ip"`
+	Port     int    `json:"port"`
+	State    string `json:"state"`
+	Reported string `json:"reported,omitempty"` // 实例自己上报的状态， 解除后恢复
+	Reason   string `json:"reason,omitempty"`
+	Operator string `json:"operator,omitempty"`
+	Time     string `json:"time"`
+}
+
+func (o *InstanceOverride) key() string {
+	return fmt.Sprintf(overridePattern, o.App, o.Group, o.IP, o.Port)
+}
+
+func (o *InstanceOverride) instKey() string {
+	return fmt.Sprintf(InstPattern, o.App, o.Group, o.IP, o.Port)
+}
+
+func (o *InstanceOverride) String() string {
+	d, _ := json.Marshal(o)
+	return string(d)
+}
+
+func FindOverride(appId, group, ip string, port int) *InstanceOverride {
+	v, err := rs.Get(fmt.Sprintf(overridePattern, appId, group, ip, port))
+	if err != nil {
+		return nil
+	}
+	o := new(InstanceOverride)
+	if err := json.Unmarshal([]byte(v), o); err != nil {
+		return nil
+	}
+	return o
+}
+
+// EffectiveState 实例上报状态时调用， 被人工设置过的以人工设置的为准， 同时记下上报的状态
+func EffectiveState(appId, group, ip string, port int, reported string) string {
+	o := FindOverride(appId, group, ip, port)
+	if o == nil {
+		return reported
+	}
+	if len(reported) > 0 && o.Reported != reported {
+		o.Reported = reported
+		if err := rs.Set(o.key(), o.String(), -1); err != nil {
+			logger.Errorln("EffectiveState - update reported state error: " + err.Error())
+		}
+	}
+	return o.State
+}
+
+// 只能人工设置为下线或者禁用， 实例不在线的也可以设置， 之后注册时即以人工设置的状态上线
+func overrideInstance(o *InstanceOverride) error {
+	if o.State != StateDown && o.State != StateDisabled {
+		return errors.New("state must be DOWN or DISABLED")
+	}
+	before, _ := rs.Get(o.instKey())
+	if existed := FindOverride(o.App, o.Group, o.IP, o.Port); existed != nil {
+		o.Reported = existed.Reported
+	} else {
+		o.Reported = before
+	}
+	o.Time = time.Now().Format(time.RFC3339)
+	if err := rs.Set(o.key(), o.String(), -1); err != nil {
+		return err
+	}
+	if len(before) == 0 {
+		return nil
+	}
+	if err := rs.Set(o.instKey(), o.State, instanceExpire); err != nil {
+		return err
+	}
+	InstanceStateChanged(o.App, o.Group, o.IP, o.Port, before, o.State)
+	return nil
+}
+
+// 解除人工设置， 实例仍然在线的恢复其上报的状态
+func clearOverride(appId, group, ip string, port int) (*InstanceOverride, error) {
+	o := FindOverride(appId, group, ip, port)
+	if o == nil {
+		return nil, errors.New("instance not overridden")
+	}
+	if err := rs.Delete(o.key()); err != nil {
+		return nil, err
+	}
+	before, err := rs.Get(o.instKey())
+	if err != nil || len(before) == 0 {
+		return o, nil
+	}
+	state := o.Reported
+	if len(state) == 0 {
+		state = StateUp
+	}
+	if err := rs.Set(o.instKey(), state, instanceExpire); err != nil {
+		return o, err
+	}
+	InstanceStateChanged(appId, group, ip, port, before, state)
+	return o, nil
+}
+
+// renameOverrides group 重命名后的人工设置， key 与内容中的group 都要修改
+func renameOverrides(kvs map[string]string, name string) map[string]string {
+	result := make(map[string]string, len(kvs))
+	for _, v := range kvs {
+		o := new(InstanceOverride)
+		if err := json.Unmarshal([]byte(v), o); err != nil {
+			continue
+		}
+		o.Group = name
+		result[o.key()] = o.String()
+	}
+	return result
+}
+
+func appOverrides(appId string) []*InstanceOverride {
+	kvs := rs.ScanKvs(fmt.Sprintf(overrideScanPattern, appId))
+	result := make([]*InstanceOverride, 0, len(kvs))
+	for _, v := range kvs {
+		o := new(InstanceOverride)
+		if err := json.Unmarshal([]byte(v), o); err == nil {
+			result = append(result, o)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].key() < result[j].key() })
+	return result
+}
@@ -1,19 +1,14 @@
 package app
 
 import (
-	"strings"
-
 	"github.com/gridsx/micro-conf/api"
 	"github.com/gridsx/micro-conf/config"
 	"github.com/gridsx/micro-conf/user"
 	"github.com/gridsx/micro-conf/user/session"
 	"github.com/kataras/iris/v12"
-	"github.com/winjeg/go-commons/cryptos"
 	"github.com/winjeg/irisword/ret"
 )
 
-var token = cryptos.Sha1([]byte(config.App.JWT.Secret))
-
 // RequirePermission 需要不同角色的role
 func RequirePermission(ctx iris.Context, r role) {
 	userinfo := session.GetUserInfo(ctx)
@@ -27,40 +22,47 @@ func RequirePermission(ctx iris.Context, r role) {
 		ctx.Next()
 		return
 	}
-	// 获取appId和用户名
-	appId := ctx.URLParam("app")
+	appId := routeApp(ctx)
 	appInfo, err := FindApp(appId)
 	if err != nil || appInfo == nil {
 		ret.ServerError(ctx, "no app found!")
 		return
 	}
-	roleStr := ""
-	// 权限 Owner > Developer > Viewer
-	switch r {
-	case Viewer:
-		roleStr = appInfo.Owners + "," + appInfo.Developers + "," + appInfo.Viewers
-	case Developer:
-		roleStr = appInfo.Developers + "," + appInfo.Owners
-	case Owner:
-		roleStr = appInfo.Owners
+	if appInfo.Allowed(user.Principals(username), r, routeGroup(ctx)) {
+		ctx.Next()
+		return
 	}
+	ret.Unauthorized(ctx, "require privilege of "+string(r))
+}
 
-	if len(roleStr) == 0 {
-		ret.Unauthorized(ctx, "require privilege of "+string(r))
-		return
+// 从路由中取app， 路由中的app 优先， 避免用参数中有权限的app 访问路由中的其他app
+// 路由中没有app 的（如依赖关系图）才使用参数 app
+func routeApp(ctx iris.Context) string {
+	if appId := ctx.Params().Get("app"); len(appId) > 0 {
+		return appId
 	}
-	roles := strings.Split(roleStr, ",")
-	for _, v := range roles {
-		if strings.EqualFold(v, username) {
-			ctx.Next()
-			return
-		}
+	if appId := ctx.Params().Get("appId"); len(appId) > 0 {
+		return appId
 	}
-	ret.Unauthorized(ctx, "require privilege of "+string(r))
+	return ctx.URLParam("app")
+}
+
+// 从路由中取group， 没有group 的路由只认app 级别的授权
+func routeGroup(ctx iris.Context) string {
+	return ctx.Params().Get("group")
 }
 
 // RequireToken 从参数中拿到app，根据app获取token, 构造SecretProvider
 func RequireToken(ctx iris.Context) {
+	checkToken(ctx, nil)
+}
+
+// RequireScope 使用凭证访问时， 凭证需要有其中任意一个范围， 使用app token 的不受限制
+func RequireScope(scopes ...string) iris.Handler {
+	return func(ctx iris.Context) { checkToken(ctx, scopes) }
+}
+
+func checkToken(ctx iris.Context, scopes []string) {
 	appId := ctx.URLParam("app")
 	if len(appId) == 0 {
 		ret.BadRequest(ctx, "param app should present")
@@ -72,6 +74,10 @@ func RequireToken(ctx iris.Context) {
 		ret.ServerError(ctx, "app info error")
 		return
 	}
+	if name := ctx.URLParam(credParam); len(name) > 0 {
+		checkCredential(ctx, appId, name, scopes)
+		return
+	}
 
 	req := ctx.Request()
 	// you can put the key somewhere in the header or url params
@@ -81,8 +87,16 @@ func RequireToken(ctx iris.Context) {
 			AppKey:    appId,
 			AppSecret: appInfo.Token,
 		})
+	used := appInfo.Token
+	// 轮换后的宽限期内， 老的token 仍然可以通过校验
+	if !r && appInfo.prevTokenValid() {
+		if r, _ = api.CheckValid(req, api.DefaultProvider{AppKey: appId, AppSecret: appInfo.PrevToken}); r {
+			used = appInfo.PrevToken
+		}
+	}
 	if r {
 		// verfy success, continue the request
+		ctx.Values().Set(TokenCtxKey, TokenFingerprint(used))
 		ctx.Next()
 	} else {
 		// verify fail, stop the request and return
@@ -92,9 +106,31 @@ func RequireToken(ctx iris.Context) {
 	}
 }
 
+func checkCredential(ctx iris.Context, appId, name string, scopes []string) {
+	cred, err := findCredential(appId, name)
+	if err != nil || cred == nil {
+		ret.Unauthorized(ctx, "credential not found")
+		ctx.StopExecution()
+		return
+	}
+	if err := cred.allow(scopes, ctx.RemoteAddr()); err != nil {
+		ret.Unauthorized(ctx, err.Error())
+		ctx.StopExecution()
+		return
+	}
+	if r, err := api.CheckValid(ctx.Request(), api.DefaultProvider{AppKey: appId, AppSecret: cred.Secret}); !r {
+		ret.Unauthorized(ctx, err.Error())
+		ctx.StopExecution()
+		return
+	}
+	ctx.Values().Set(TokenCtxKey, TokenFingerprint(cred.Secret))
+	ctx.Values().Set(CredCtxKey, cred.Name)
+	ctx.Values().Set(ScopeCtxKey, cred.Scopes)
+	ctx.Next()
+}
+
 func RequireAdmin(ctx iris.Context) {
-	authToken := ctx.GetHeader("_inner_auth")
-	if strings.EqualFold(token, authToken) {
+	if config.IsInner(ctx.GetHeader(config.InnerAuthHeader)) {
 		ctx.Next()
 		return
 	}
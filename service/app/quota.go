@@ -0,0 +1,180 @@
+package app
+
+/// app 的配额， 限制单个app 在raft 存储中占用的空间以及心跳频率
+/// 默认值来自配置， 管理员可以为单个app 覆盖， 0 表示使用默认值， 小于0 表示不限制
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/gridsx/micro-conf/config"
+)
+
+const quotaPattern = "app.quota.%s"
+
+type Quota = config.QuotaConfig
+
+// 配置中也没有指定时使用的默认值
+var builtinQuota = Quota{
+	Namespaces:    50,
+	NamespaceSize: 256 * 1024,
+	HistoryDepth:  100,
+	Instances:     500,
+	HeartbeatRate: 60,
+}
+
+// QuotaError 超出配额， 错误信息中包含配额与当前用量
+type QuotaError struct {
+	Item  string
+	Limit int
+	Used  int
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded: %s limit %d, used %d", e.Item, e.Limit, e.Used)
+}
+
+// 后面非0 的值覆盖前面的
+func mergeQuota(quotas ...*Quota) *Quota {
+	result := new(Quota)
+	for _, q := range quotas {
+		if q == nil {
+			continue
+		}
+		pick := func(dst *int, v int) {
+			if v != 0 {
+				*dst = v
+			}
+		}
+		pick(&result.Namespaces, q.Namespaces)
+		pick(&result.NamespaceSize, q.NamespaceSize)
+		pick(&result.HistoryDepth, q.HistoryDepth)
+		pick(&result.Instances, q.Instances)
+		pick(&result.HeartbeatRate, q.HeartbeatRate)
+	}
+	return result
+}
+
+func quotaOverride(appId string) *Quota {
+	v, err := rs.Get(fmt.Sprintf(quotaPattern, appId))
+	if err != nil {
+		return nil
+	}
+	q := new(Quota)
+	if err := json.Unmarshal([]byte(v), q); err != nil {
+		return nil
+	}
+	return q
+}
+
+func setQuotaOverride(appId string, q *Quota) error {
+	d, _ := json.Marshal(q)
+	return rs.Set(fmt.Sprintf(quotaPattern, appId), string(d), -1)
+}
+
+// EffectiveQuota 内置默认值、配置以及app 单独设置的配额合并后的结果
+func EffectiveQuota(appId string) *Quota {
+	return mergeQuota(&builtinQuota, &config.App.Quota, quotaOverride(appId))
+}
+
+func checkLimit(item string, limit, used int) error {
+	if limit >= 0 && used >= limit {
+		return &QuotaError{Item: item, Limit: limit, Used: used}
+	}
+	return nil
+}
+
+// CheckNamespaceCount 新建namespace 之前校验数量
+func CheckNamespaceCount(appId string) error {
+	used := len(rs.ScanKeys(fmt.Sprintf("app.cfg.current.%s.", appId)))
+	return checkLimit("namespaces", EffectiveQuota(appId).Namespaces, used)
+}
+
+// CheckNamespaceSize 校验namespace 内容的大小
+func CheckNamespaceSize(appId, content string) error {
+	limit := EffectiveQuota(appId).NamespaceSize
+	if limit >= 0 && len(content) > limit {
+		return &QuotaError{Item: "namespace size", Limit: limit, Used: len(content)}
+	}
+	return nil
+}
+
+// checkNewNamespaces 一次新建多个namespace 之前校验数量以及每个的大小， 如复制app、group 或者按模板创建
+func checkNewNamespaces(appId string, contents []string) error {
+	limit := EffectiveQuota(appId).Namespaces
+	used := len(rs.ScanKeys(fmt.Sprintf("app.cfg.current.%s.", appId)))
+	if limit >= 0 && used+len(contents) > limit {
+		return &QuotaError{Item: "namespaces", Limit: limit, Used: used + len(contents)}
+	}
+	for _, c := range contents {
+		if err := CheckNamespaceSize(appId, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapValues(kvs map[string]string) []string {
+	result := make([]string, 0, len(kvs))
+	for _, v := range kvs {
+		result = append(result, v)
+	}
+	return result
+}
+
+// CheckInstances 新的实例注册前校验数量， 已经注册的实例不受影响
+func CheckInstances(appId, instKey string) error {
+	if _, err := rs.Get(instKey); err == nil {
+		return nil
+	}
+	used := len(rs.ScanKeys(fmt.Sprintf("app.instance.info.%s.", appId)))
+	return checkLimit("instances", EffectiveQuota(appId).Instances, used)
+}
+
+// HistoryDepth 每个namespace 保留的历史版本数， 小于0 不限制
+func HistoryDepth(appId string) int {
+	return EffectiveQuota(appId).HistoryDepth
+}
+
+// HeartbeatRate 每个实例每分钟最多处理的心跳数， 小于等于0 不限制
+func HeartbeatRate(appId string) int {
+	return EffectiveQuota(appId).HeartbeatRate
+}
+
+type QuotaUsage struct {
+	Namespaces    int `json:"namespaces"`
+	NamespaceSize int `json:"namespaceSize"` // 最大的namespace 内容字节数
+	HistoryDepth  int `json:"historyDepth"`  // 历史版本最多的namespace 的版本数
+	Instances     int `json:"instances"`
+}
+
+type AppQuota struct {
+	Limit *Quota      `json:"limit"`
+	Usage *QuotaUsage `json:"usage"`
+}
+
+func appQuota(appId string) *AppQuota {
+	usage := new(QuotaUsage)
+	current := rs.ScanKvs(fmt.Sprintf("app.cfg.current.%s.", appId))
+	usage.Namespaces = len(current)
+	for _, v := range current {
+		if len(v) > usage.NamespaceSize {
+			usage.NamespaceSize = len(v)
+		}
+	}
+	// app.cfg.history.app.group.ns.time， 去掉时间后按namespace 计数
+	histories := make(map[string]int, defaultSize)
+	for _, k := range rs.ScanKeys(fmt.Sprintf("app.cfg.history.%s.", appId)) {
+		if idx := strings.LastIndex(k, "."); idx > 0 {
+			histories[k[:idx]]++
+		}
+	}
+	for _, c := range histories {
+		if c > usage.HistoryDepth {
+			usage.HistoryDepth = c
+		}
+	}
+	usage.Instances = len(rs.ScanKeys(fmt.Sprintf("app.instance.info.%s.", appId)))
+	return &AppQuota{Limit: EffectiveQuota(appId), Usage: usage}
+}
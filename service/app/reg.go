@@ -81,6 +81,9 @@ func regApp(appInfo *InstanceInfo) error {
 	if err := appInfo.Valid(); err != nil {
 		return err
 	}
+	if err := CheckInstances(appInfo.AppId, appInfo.InstKey()); err != nil {
+		return err
+	}
 	// 第一次需严格按照传递过来的执行
 	metaKey := appInfo.MetaKey()
 	if err := rs.Set(metaKey, appInfo.MetaString(), MetaExpire); err != nil {
@@ -94,7 +97,13 @@ func regApp(appInfo *InstanceInfo) error {
 		}
 	}
 	instKey := appInfo.InstKey()
-	return rs.Set(instKey, appInfo.State, instanceExpire)
+	before, _ := rs.Get(instKey)
+	state := EffectiveState(appInfo.AppId, appInfo.Group, appInfo.IP, appInfo.Port, appInfo.State)
+	if err := rs.Set(instKey, state, instanceExpire); err != nil {
+		return err
+	}
+	InstanceStateChanged(appInfo.AppId, appInfo.Group, appInfo.IP, appInfo.Port, before, state)
+	return nil
 }
 
 var logger = log.GetLogger(nil)
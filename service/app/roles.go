@@ -0,0 +1,136 @@
+package app
+
+/// 角色可以授予整个app， 也可以只授予某个group
+/// 权限 Owner > Developer > Viewer， group 上的授权只对该group 下的操作生效
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/winjeg/go-commons/str"
+)
+
+// Roles 各角色对应的用户， 逗号分隔
+type Roles struct {
+	Owners     string `json:"owners,omitempty"`
+	Developers string `json:"developers,omitempty"`
+	Viewers    string `json:"viewers,omitempty"`
+}
+
+func (r *Roles) users(ro role) *string {
+	switch ro {
+	case Owner:
+		return &r.Owners
+	case Developer:
+		return &r.Developers
+	case Viewer:
+		return &r.Viewers
+	}
+	return nil
+}
+
+func (r *Roles) add(ro role, username string) error {
+	users := r.users(ro)
+	if users == nil {
+		return errors.New("unknown role")
+	}
+	if !contains(*users, username) {
+		*users = str.TrimComma(*users + "," + username)
+	}
+	return nil
+}
+
+func (r *Roles) remove(ro role, username string) error {
+	users := r.users(ro)
+	if users == nil {
+		return errors.New("unknown role")
+	}
+	*users = removePart(*users, username)
+	return nil
+}
+
+// has 用户或其所在的团队是否拥有某角色， 高级别的角色包含低级别的
+func (r *Roles) has(ro role, principals []string) bool {
+	if r == nil {
+		return false
+	}
+	users := ""
+	switch ro {
+	case Viewer:
+		users = r.Owners + "," + r.Developers + "," + r.Viewers
+	case Developer:
+		users = r.Developers + "," + r.Owners
+	case Owner:
+		users = r.Owners
+	}
+	for _, p := range principals {
+		if contains(users, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Roles) empty() bool {
+	return len(r.Owners) == 0 && len(r.Developers) == 0 && len(r.Viewers) == 0
+}
+
+// groupRoles group 为空的是app 级别的授权
+func (i *AppInfo) groupRoles(group string, create bool) *Roles {
+	if len(group) == 0 {
+		return &i.Roles
+	}
+	if i.Scoped == nil && create {
+		i.Scoped = make(map[string]*Roles, defaultSize)
+	}
+	roles := i.Scoped[group]
+	if roles == nil && create {
+		roles = new(Roles)
+		i.Scoped[group] = roles
+	}
+	return roles
+}
+
+// Allowed 用户在某group 下是否拥有角色， group 为空时只看app 级别的授权，
+// 但任意group 上有授权的用户都可以查看app， principals 为用户以及其所在的团队
+func (i *AppInfo) Allowed(principals []string, r role, group string) bool {
+	if i.Roles.has(r, principals) {
+		return true
+	}
+	if len(group) > 0 {
+		return i.Scoped[group].has(r, principals)
+	}
+	if r == Viewer {
+		for _, roles := range i.Scoped {
+			if roles.has(Viewer, principals) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// members 在app 或者任意group 上有角色的所有用户与团队
+func (i *AppInfo) members() []string {
+	all := []*Roles{&i.Roles}
+	for _, roles := range i.Scoped {
+		all = append(all, roles)
+	}
+	result := make([]string, 0, defaultSize)
+	for _, roles := range all {
+		for _, u := range strings.Split(roles.Owners+","+roles.Developers+","+roles.Viewers, ",") {
+			if len(u) > 0 && !str.Contains(result, u) {
+				result = append(result, u)
+			}
+		}
+	}
+	return result
+}
+
+// 审计日志中记录的角色信息
+func appRoles(info *AppInfo) map[string]interface{} {
+	if info == nil {
+		return nil
+	}
+	return map[string]interface{}{"roles": info.Roles, "scoped": info.Scoped}
+}
@@ -0,0 +1,150 @@
+package app
+
+/// app 的搜索、排序与游标分页
+/// 游标为上一页最后一个app 的排序值与appId， 翻页期间有新增或删除也不会重复或遗漏
+
+import (
+	"encoding/base64"
+	"sort"
+	"strings"
+
+	"github.com/kataras/iris/v12"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 200
+)
+
+type AppQuery struct {
+	Name       string            // appId 或者名称包含， 不区分大小写
+	Department string            // 部门完全匹配
+	Owner      string            // app 或者任意group 的Owner
+	Labels     map[string]string // 需要全部匹配
+	Sort       string            // appId, name, createTime， 加 - 前缀降序
+	Cursor     string
+	Size       int
+}
+
+type AppPage struct {
+	Items []*AppInfo `json:"items"`
+	Next  string     `json:"next,omitempty"` // 为空表示没有下一页
+	Total int        `json:"total"`          // 符合条件的总数
+}
+
+// 参数 label 可以有多个， 格式为 key:value
+func readAppQuery(ctx iris.Context) *AppQuery {
+	q := &AppQuery{
+		Name:       ctx.URLParam("name"),
+		Department: ctx.URLParam("department"),
+		Owner:      ctx.URLParam("owner"),
+		Sort:       ctx.URLParamDefault("sort", "appId"),
+		Cursor:     ctx.URLParam("cursor"),
+		Size:       ctx.URLParamIntDefault("size", defaultPageSize),
+		Labels:     make(map[string]string, defaultSize),
+	}
+	for _, l := range ctx.URLParamSlice("label") {
+		if k, v, ok := strings.Cut(l, ":"); ok {
+			q.Labels[k] = v
+		}
+	}
+	return q
+}
+
+func (q *AppQuery) match(info *AppInfo) bool {
+	if len(q.Name) > 0 {
+		name := strings.ToLower(q.Name)
+		if !strings.Contains(strings.ToLower(info.AppId), name) && !strings.Contains(strings.ToLower(info.Name), name) {
+			return false
+		}
+	}
+	if len(q.Department) > 0 && !strings.EqualFold(info.Department, q.Department) {
+		return false
+	}
+	if len(q.Owner) > 0 {
+		owned := contains(info.Owners, q.Owner)
+		for _, roles := range info.Scoped {
+			owned = owned || contains(roles.Owners, q.Owner)
+		}
+		if !owned {
+			return false
+		}
+	}
+	for k, v := range q.Labels {
+		if info.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *AppQuery) sortValue(info *AppInfo) string {
+	switch strings.TrimPrefix(q.Sort, "-") {
+	case "name":
+		return info.Name
+	case "createTime":
+		return info.CreateTime
+	}
+	return info.AppId
+}
+
+// 先比较排序值， 相同的再比较appId
+func (q *AppQuery) compare(value, appId string, info *AppInfo) int {
+	r := strings.Compare(value, q.sortValue(info))
+	if r == 0 {
+		r = strings.Compare(appId, info.AppId)
+	}
+	if strings.HasPrefix(q.Sort, "-") {
+		return -r
+	}
+	return r
+}
+
+func encodeCursor(value, appId string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(value + "\n" + appId))
+}
+
+func decodeCursor(cursor string) (string, string, bool) {
+	d, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(d), "\n")
+}
+
+func searchApps(apps []*AppInfo, q *AppQuery) *AppPage {
+	matched := make([]*AppInfo, 0, len(apps))
+	for _, info := range apps {
+		if q.match(info) {
+			matched = append(matched, info)
+		}
+	}
+	sortApps(matched, q)
+	page := &AppPage{Total: len(matched), Items: make([]*AppInfo, 0, defaultSize)}
+	start := 0
+	if value, appId, ok := decodeCursor(q.Cursor); ok && len(q.Cursor) > 0 {
+		for start < len(matched) && q.compare(value, appId, matched[start]) >= 0 {
+			start++
+		}
+	}
+	size := q.Size
+	if size <= 0 || size > maxPageSize {
+		size = defaultPageSize
+	}
+	end := start + size
+	if end > len(matched) {
+		end = len(matched)
+	}
+	page.Items = append(page.Items, matched[start:end]...)
+	if end < len(matched) {
+		last := matched[end-1]
+		page.Next = encodeCursor(q.sortValue(last), last.AppId)
+	}
+	return page
+}
+
+func sortApps(apps []*AppInfo, q *AppQuery) {
+	sort.Slice(apps, func(i, j int) bool {
+		return q.compare(q.sortValue(apps[i]), apps[i].AppId, apps[j]) < 0
+	})
+}
@@ -3,6 +3,7 @@ package app
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -23,12 +24,17 @@ type ServiceInfo struct {
 	State            string                 `json:"state,omitempty"`
 	Meta             map[string]interface{} `json:"meta,omitempty"`
 	HeartbeatTimeout int                    `json:"timeout,omitempty"`
+	Health           string                 `json:"health,omitempty"` // 配置了健康检查的服务才有， HEALTHY/UNHEALTHY
 }
 
 func ServiceInfos(svc *ServiceInfo) []ServiceInfo {
 	stateMap := rs.ScanKvs(fmt.Sprintf(InstanceScanPattern, svc.App, svc.Group))
 	services := make([]ServiceInfo, 0, defaultSize)
 	metaMap := rs.ScanKvs(fmt.Sprintf(MetaScanPattern, svc.App, svc.Group))
+	var unhealthy map[string]*HealthResult
+	if FindHealthCheck(svc.App, svc.Group) != nil {
+		unhealthy = unhealthyInstances(svc.App, svc.Group)
+	}
 	for k, v := range stateMap {
 		appInfo := extractAppInfo(k)
 		if appInfo == nil || len(appInfo.IP) == 0 || appInfo.Port == 0 {
@@ -43,15 +49,30 @@ func ServiceInfos(svc *ServiceInfo) []ServiceInfo {
 			}
 		}
 
+		health := ""
+		if unhealthy != nil {
+			health = HealthHealthy
+			if _, ok := unhealthy[fmt.Sprintf("%s:%d", appInfo.IP, appInfo.Port)]; ok {
+				health = HealthUnhealthy
+			}
+		}
 		services = append(services, ServiceInfo{
-			App:   svc.App,
-			Group: svc.Group,
-			IP:    appInfo.IP,
-			Port:  appInfo.Port,
-			State: v,
-			Meta:  mm,
+			App:    svc.App,
+			Group:  svc.Group,
+			IP:     appInfo.IP,
+			Port:   appInfo.Port,
+			State:  v,
+			Meta:   mm,
+			Health: health,
 		})
 	}
+	// 按地址排序， 便于客户端以及推送时比对变化
+	sort.Slice(services, func(i, j int) bool {
+		if services[i].IP != services[j].IP {
+			return services[i].IP < services[j].IP
+		}
+		return services[i].Port < services[j].Port
+	})
 	return services
 }
 
@@ -0,0 +1,157 @@
+package app
+
+/// 管理员维护的模板， 包含若干个group以及带初始内容的namespace
+/// 创建app或者namespace的时候可以指定模板， 内容中的 ${appId} ${group} ${namespace} 会被替换
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	templatePattern     = "app.template.%s"
+	templateScanPattern = "app.template."
+
+	defaultGroup     = "default"
+	defaultNamespace = "app.props"
+)
+
+var namespaceFormats = []string{".yaml", ".yml", ".json", ".props"}
+
+type TemplateNamespace struct {
+	Group     string `json:"group"`
+	Namespace string `json:"namespace"`
+	Content   string `json:"content,omitempty"`
+}
+
+// Render 替换内容中的变量
+func (n *TemplateNamespace) Render(vars map[string]string) string {
+	pairs := make([]string, 0, len(vars)*2)
+	for k, v := range vars {
+		pairs = append(pairs, "${"+k+"}", v)
+	}
+	return strings.NewReplacer(pairs...).Replace(n.Content)
+}
+
+type Template struct {
+	Name       string               `json:"name"`
+	Detail     string               `json:"detail,omitempty"`
+	Groups     []string             `json:"groups,omitempty"` // 不带namespace 的group 也可以在此列出
+	Namespaces []*TemplateNamespace `json:"namespaces,omitempty"`
+	Creator    string               `json:"creator,omitempty"`
+	CreateTime string               `json:"createTime"`
+}
+
+func (t *Template) Valid() error {
+	if !namePattern.Match([]byte(t.Name)) {
+		return errors.New("template name illegal")
+	}
+	for _, g := range t.Groups {
+		if !namePattern.MatchString(g) {
+			return errors.New("template group illegal: " + g)
+		}
+	}
+	for _, ns := range t.Namespaces {
+		if !namePattern.MatchString(ns.Group) {
+			return errors.New("template group illegal: " + ns.Group)
+		}
+		valid := false
+		for _, f := range namespaceFormats {
+			valid = valid || str.EndsWith(ns.Namespace, f)
+		}
+		if !valid {
+			return errors.New("template namespace illegal: " + ns.Namespace)
+		}
+	}
+	return nil
+}
+
+func (t *Template) String() string {
+	d, _ := json.Marshal(t)
+	return string(d)
+}
+
+// AllGroups 模板包含的所有group， 保持定义的顺序
+func (t *Template) AllGroups() []string {
+	groups := make([]string, 0, len(t.Groups)+len(t.Namespaces))
+	for _, g := range t.Groups {
+		if !str.Contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	for _, ns := range t.Namespaces {
+		if !str.Contains(groups, ns.Group) {
+			groups = append(groups, ns.Group)
+		}
+	}
+	if len(groups) == 0 {
+		groups = append(groups, defaultGroup)
+	}
+	return groups
+}
+
+// FindNamespace 找到模板中的namespace， 优先取同一个group下的
+func (t *Template) FindNamespace(group, namespace string) *TemplateNamespace {
+	var found *TemplateNamespace
+	for _, ns := range t.Namespaces {
+		if ns.Namespace != namespace {
+			continue
+		}
+		if ns.Group == group {
+			return ns
+		}
+		if found == nil {
+			found = ns
+		}
+	}
+	return found
+}
+
+func FindTemplate(name string) (*Template, error) {
+	v, err := rs.Get(fmt.Sprintf(templatePattern, name))
+	if err != nil {
+		return nil, err
+	}
+	t := new(Template)
+	if err := json.Unmarshal([]byte(v), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func saveTemplate(t *Template) error {
+	if err := t.Valid(); err != nil {
+		return err
+	}
+	if len(t.CreateTime) == 0 {
+		t.CreateTime = time.Now().Format(time.RFC3339)
+	}
+	return rs.Set(fmt.Sprintf(templatePattern, t.Name), t.String(), -1)
+}
+
+func removeTemplate(name string) error {
+	return rs.Delete(fmt.Sprintf(templatePattern, name))
+}
+
+func allTemplates() []*Template {
+	kvs := rs.ScanKvs(templateScanPattern)
+	result := make([]*Template, 0, len(kvs))
+	for _, v := range kvs {
+		t := new(Template)
+		if err := json.Unmarshal([]byte(v), t); err != nil {
+			continue
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+// TemplateVars 模板内置的变量
+func TemplateVars(appId, group, namespace string) map[string]string {
+	return map[string]string{"appId": appId, "group": group, "namespace": namespace}
+}
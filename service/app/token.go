@@ -0,0 +1,112 @@
+package app
+
+/// token 轮换， 轮换后老的token 在宽限期内仍然有效
+/// 客户端签名时使用的token 以指纹的形式记录在连接信息中， 便于找出仍在使用老token 的实例
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gridsx/micro-conf/config"
+	"github.com/winjeg/go-commons/cryptos"
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	defaultTokenGrace = time.Hour * 24
+	fingerprintLen    = 8
+	TokenCtxKey       = "app.token" // 请求上下文中记录的token 指纹
+	CredCtxKey        = "app.cred"  // 请求上下文中记录的凭证名称， 使用app token 的为空
+)
+
+// TokenFingerprint token 的指纹， 用于展示而不暴露token 本身
+func TokenFingerprint(token string) string {
+	if len(token) == 0 {
+		return ""
+	}
+	return cryptos.Sha1([]byte(token))[:fingerprintLen]
+}
+
+// 老token 是否仍在宽限期内
+func (i *AppInfo) prevTokenValid() bool {
+	if len(i.PrevToken) == 0 {
+		return false
+	}
+	expire, err := time.Parse(time.RFC3339, i.PrevTokenExpire)
+	return err == nil && time.Now().Before(expire)
+}
+
+// 未指定宽限期的使用配置的时长
+func tokenGrace(seconds int) time.Duration {
+	switch {
+	case seconds < 0:
+		return 0
+	case seconds > 0:
+		return time.Duration(seconds) * time.Second
+	case config.App.Token.Grace > 0:
+		return time.Duration(config.App.Token.Grace) * time.Second
+	}
+	return defaultTokenGrace
+}
+
+// rotateToken 生成新的token， 老token 在宽限期内仍然有效， grace 小于0 则立即失效
+func rotateToken(appId string, grace int) (*AppInfo, error) {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return nil, errors.New("app does not exist")
+	}
+	if d := tokenGrace(grace); d > 0 {
+		info.PrevToken = info.Token
+		info.PrevTokenExpire = time.Now().Add(d).Format(time.RFC3339)
+	} else {
+		info.PrevToken, info.PrevTokenExpire = "", ""
+	}
+	info.Token = str.RandomNumAlphabets(tokenLen)
+	if err := rs.Set(fmt.Sprintf(appInfoPattern, appId), info.String(), -1); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+type TokenConn struct {
+	Key        string `json:"key"`
+	Node       string `json:"node,omitempty"`
+	Token      string `json:"token"`
+	Credential string `json:"credential,omitempty"` // 使用命名凭证连接的， 凭证的名称
+	Previous   bool   `json:"previous"`             // 是否使用的是老token
+}
+
+type TokenUsage struct {
+	Current         string       `json:"current"`
+	Previous        string       `json:"previous,omitempty"`
+	PrevTokenExpire string       `json:"prevTokenExpire,omitempty"`
+	Connections     []*TokenConn `json:"connections"`
+}
+
+// tokenUsage 当前连接的实例各自使用的token
+func tokenUsage(appId string) (*TokenUsage, error) {
+	info, _ := FindApp(appId)
+	if info == nil {
+		return nil, errors.New("app does not exist")
+	}
+	usage := &TokenUsage{Current: TokenFingerprint(info.Token), Connections: make([]*TokenConn, 0, defaultSize)}
+	if info.prevTokenValid() {
+		usage.Previous = TokenFingerprint(info.PrevToken)
+		usage.PrevTokenExpire = info.PrevTokenExpire
+	}
+	for k, v := range rs.ScanKvs(fmt.Sprintf(ConnPattern, appId+":")) {
+		c := new(ConnInfo)
+		if err := json.Unmarshal([]byte(v), c); err != nil {
+			continue
+		}
+		key := strings.TrimPrefix(k, fmt.Sprintf(ConnPattern, ""))
+		conn := &TokenConn{Key: key, Node: c.Node, Token: c.Token, Credential: c.Credential}
+		// 凭证的指纹与app token 都不相同， 只有与老token 一致的才需要更新
+		conn.Previous = len(usage.Previous) > 0 && c.Token == usage.Previous
+		usage.Connections = append(usage.Connections, conn)
+	}
+	return usage, nil
+}
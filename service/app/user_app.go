@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/gridsx/micro-conf/user"
 	"github.com/winjeg/go-commons/str"
 )
 
@@ -62,7 +63,7 @@ func removeApp(username, appId, pattern string) error {
 	remainApps := make([]string, 0, len(apps))
 	for _, v := range apps {
 		if !strings.EqualFold(v, appId) {
-			remainApps = append(remainApps, appId)
+			remainApps = append(remainApps, v)
 		}
 	}
 	modifiedStr := str.Join(remainApps, ",")
@@ -77,10 +78,16 @@ type userApps struct {
 	Bookmarks map[string]*AppInfo `json:"bookmarks,omitempty"`
 }
 
+// 包括通过团队获得角色的app
 func appList(username string) *userApps {
-
+	apps := make(map[string]*AppInfo, defaultSize)
+	for _, p := range user.Principals(username) {
+		for k, v := range getApps(p, UserAppPattern) {
+			apps[k] = v
+		}
+	}
 	return &userApps{
-		Apps:      getApps(username, UserAppPattern),
+		Apps:      apps,
 		Bookmarks: getApps(username, UserAppBookMark),
 	}
 }
@@ -0,0 +1,235 @@
+package audit
+
+/// 统一的审计日志， 记录所有修改操作的操作人、来源IP、目标以及修改前后的摘要
+/// 只追加不修改， 存放在raft 存储中， key 中带有纳秒时间， 按字典序即是时间顺序
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gridsx/micro-conf/config"
+	"github.com/gridsx/micro-conf/store"
+	"github.com/gridsx/micro-conf/user/session"
+	"github.com/kataras/iris/v12"
+	"github.com/winjeg/go-commons/cryptos"
+	"github.com/winjeg/go-commons/log"
+	"github.com/winjeg/go-commons/str"
+)
+
+const (
+	auditPattern     = "audit.%019d.%s" // 纳秒时间， ID
+	auditScanPattern = "audit."
+	auditScanEnd     = "audit/" // 字典序紧接在所有审计日志之后， 作为扫描的上界
+	innerActor       = "_inner"
+	anonymousActor   = "anonymous"
+	idLen            = 8
+	maxSummaryLen    = 1024
+	defaultPageSize  = 50
+	maxPageSize      = 500
+)
+
+var (
+	rs     = store.GetRaftStore()
+	logger = log.GetLogger(nil)
+)
+
+type Entry struct {
+	Id     string    `json:"id"`
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	IP     string    `json:"ip,omitempty"`
+	Action string    `json:"action"`           // 如 app.create, namespace.release
+	Target string    `json:"target"`           // 如 app:DemoService, namespace:DemoService/default/app.props
+	Before string    `json:"before,omitempty"` // 修改前的摘要
+	After  string    `json:"after,omitempty"`  // 修改后的摘要
+}
+
+// IsInner 集群内部节点转发的请求， 已经在发起的节点上记录过
+func IsInner(ctx iris.Context) bool {
+	return config.IsInner(ctx.GetHeader(config.InnerAuthHeader))
+}
+
+// Record 记录当前登录用户的操作
+func Record(ctx iris.Context, action, target string, before, after interface{}) {
+	actor := anonymousActor
+	if IsInner(ctx) {
+		actor = innerActor
+	} else if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		actor = userInfo.Username
+	}
+	RecordAs(ctx, actor, action, target, before, after)
+}
+
+// RecordAs 指定操作人， 用于登录等还没有会话的场景
+func RecordAs(ctx iris.Context, actor, action, target string, before, after interface{}) {
+	Log(&Entry{
+		Actor:  actor,
+		IP:     ctx.RemoteAddr(),
+		Action: action,
+		Target: target,
+		Before: Summary(before),
+		After:  Summary(after),
+	})
+}
+
+func Log(e *Entry) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Id = str.RandomNumAlphabets(idLen)
+	d, _ := json.Marshal(e)
+	key := fmt.Sprintf(auditPattern, e.Time.UnixNano(), e.Id)
+	if err := rs.Set(key, string(d), -1); err != nil {
+		logger.Errorf("audit - %s %s by %s err: %s\n", e.Action, e.Target, e.Actor, err.Error())
+	}
+}
+
+// Summary 字符串原样保留， 其他的转为json， 超长的截断
+func Summary(v interface{}) string {
+	if v == nil {
+		return ""
+	}
+	s, ok := v.(string)
+	if !ok {
+		d, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		s = string(d)
+	}
+	if len(s) <= maxSummaryLen {
+		return s
+	}
+	// 截断在完整的字符处， 避免产生非法的utf8
+	end := maxSummaryLen
+	for end > 0 && !utf8.RuneStart(s[end]) {
+		end--
+	}
+	return s[:end] + "..."
+}
+
+// Digest 不宜记录原文的内容（如配置、底层存储的值）只记录其sha1， 空内容返回空
+func Digest(content string) string {
+	if len(content) == 0 {
+		return ""
+	}
+	return "sha1:" + cryptos.Sha1([]byte(content))
+}
+
+// Protected 审计日志所在的key， 不能通过底层存储的接口修改或者删除
+func Protected(key string) bool {
+	return strings.HasPrefix(key, auditScanPattern)
+}
+
+type Query struct {
+	Actor  string
+	Action string // 前缀匹配， 如 namespace 匹配所有 namespace 的操作
+	Target string // 包含
+	From   time.Time
+	To     time.Time
+	Cursor string
+	Size   int
+}
+
+// ReadQuery 时间参数为 RFC3339 格式
+func ReadQuery(ctx iris.Context) *Query {
+	q := &Query{
+		Actor:  ctx.URLParam("actor"),
+		Action: ctx.URLParam("action"),
+		Target: ctx.URLParam("target"),
+		Cursor: ctx.URLParam("cursor"),
+		Size:   ctx.URLParamIntDefault("size", defaultPageSize),
+	}
+	q.From, _ = time.Parse(time.RFC3339, ctx.URLParam("from"))
+	q.To, _ = time.Parse(time.RFC3339, ctx.URLParam("to"))
+	return q
+}
+
+func (q *Query) match(e *Entry) bool {
+	if len(q.Actor) > 0 && e.Actor != q.Actor {
+		return false
+	}
+	if len(q.Action) > 0 && !strings.HasPrefix(e.Action, q.Action) {
+		return false
+	}
+	if len(q.Target) > 0 && !strings.Contains(e.Target, q.Target) {
+		return false
+	}
+	if !q.From.IsZero() && e.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && e.Time.After(q.To) {
+		return false
+	}
+	return true
+}
+
+// 扫描的key 范围 [from, to)， 由时间范围与游标确定， key 中带有纳秒时间， 按字典序即是时间顺序
+func (q *Query) bounds() (string, string) {
+	from, to := auditScanPattern, auditScanEnd
+	if !q.From.IsZero() {
+		from = fmt.Sprintf(auditPattern, q.From.UnixNano(), "")
+	}
+	if !q.To.IsZero() {
+		to = fmt.Sprintf(auditPattern, q.To.UnixNano()+1, "")
+	}
+	if len(q.Cursor) > 0 && q.Cursor < to {
+		to = q.Cursor
+	}
+	return from, to
+}
+
+// 按时间倒序遍历符合条件的日志， fn 返回false 时停止
+func (q *Query) each(fn func(e *Entry) bool) {
+	from, to := q.bounds()
+	rs.ScanRange(from, to, func(k, v string) bool {
+		e := new(Entry)
+		if err := json.Unmarshal([]byte(v), e); err != nil || !q.match(e) {
+			return true
+		}
+		return fn(e)
+	})
+}
+
+type Page struct {
+	Items []*Entry `json:"items"`
+	Next  string   `json:"next,omitempty"` // 为空表示没有更早的日志
+}
+
+func Search(q *Query) *Page {
+	size := q.Size
+	if size <= 0 || size > maxPageSize {
+		size = defaultPageSize
+	}
+	page := &Page{Items: make([]*Entry, 0, size)}
+	q.each(func(e *Entry) bool {
+		if len(page.Items) == size {
+			last := page.Items[size-1]
+			page.Next = fmt.Sprintf(auditPattern, last.Time.UnixNano(), last.Id)
+			return false
+		}
+		page.Items = append(page.Items, e)
+		return true
+	})
+	return page
+}
+
+// Export 以 JSON lines 的格式导出符合条件的所有日志， 忽略分页参数
+func Export(q *Query, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	var err error
+	q.each(func(e *Entry) bool {
+		err = enc.Encode(e)
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,77 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryMatch(t *testing.T) {
+	now := time.Now()
+	e := &Entry{Time: now, Actor: "admin", Action: "namespace.release", Target: "namespace:demo/default/app.props"}
+	assert.True(t, (&Query{}).match(e))
+	assert.True(t, (&Query{Actor: "admin", Action: "namespace", Target: "demo/"}).match(e))
+	assert.False(t, (&Query{Actor: "bob"}).match(e))
+	assert.False(t, (&Query{Action: "app"}).match(e))
+	assert.True(t, (&Query{From: now.Add(-time.Minute), To: now.Add(time.Minute)}).match(e))
+	assert.False(t, (&Query{From: now.Add(time.Minute)}).match(e))
+	assert.False(t, (&Query{To: now.Add(-time.Minute)}).match(e))
+}
+
+func TestQueryBounds(t *testing.T) {
+	from, to := (&Query{}).bounds()
+	assert.Equal(t, auditScanPattern, from)
+	assert.Equal(t, auditScanEnd, to)
+
+	start, end := time.Unix(100, 0), time.Unix(200, 0)
+	inRange := fmt.Sprintf(auditPattern, end.UnixNano(), "abc")
+	from, to = (&Query{From: start, To: end}).bounds()
+	assert.True(t, fmt.Sprintf(auditPattern, start.UnixNano(), "abc") >= from)
+	assert.True(t, fmt.Sprintf(auditPattern, start.UnixNano()-1, "abc") < from)
+	assert.True(t, inRange < to)
+	assert.True(t, fmt.Sprintf(auditPattern, end.UnixNano()+1, "abc") >= to)
+
+	cursor := fmt.Sprintf(auditPattern, time.Unix(150, 0).UnixNano(), "xyz")
+	_, to = (&Query{To: end, Cursor: cursor}).bounds()
+	assert.Equal(t, cursor, to)
+	_, to = (&Query{To: start, Cursor: cursor}).bounds()
+	assert.True(t, to < cursor)
+}
+
+func TestSummary(t *testing.T) {
+	assert.Equal(t, "", Summary(nil))
+	assert.Equal(t, "a=b", Summary("a=b"))
+	assert.Equal(t, `{"k":"v"}`, Summary(map[string]string{"k": "v"}))
+	long := Summary(strings.Repeat("x", maxSummaryLen*2))
+	assert.Equal(t, maxSummaryLen+3, len(long))
+	// 中文每个字符3个字节， 截断不能落在字符中间
+	cn := Summary(strings.Repeat("配置", maxSummaryLen))
+	assert.True(t, utf8.ValidString(cn))
+	assert.True(t, len(cn) <= maxSummaryLen+3)
+
+	assert.Equal(t, "", Digest(""))
+	assert.Equal(t, 45, len(Digest("a=b")))
+	assert.True(t, Protected("audit.0001.abc"))
+	assert.False(t, Protected("app.info.demo"))
+}
+
+func TestThrottle(t *testing.T) {
+	th := &throttler{states: make(map[string]*throttleState)}
+	now := time.Now()
+	record, merged := th.hit("bob", now)
+	assert.True(t, record)
+	assert.Equal(t, 0, merged)
+	record, _ = th.hit("bob", now.Add(time.Second))
+	assert.False(t, record)
+	record, _ = th.hit("bob", now.Add(2*time.Second))
+	assert.False(t, record)
+	record, _ = th.hit("alice", now.Add(2*time.Second))
+	assert.True(t, record)
+	record, merged = th.hit("bob", now.Add(throttleWindow))
+	assert.True(t, record)
+	assert.Equal(t, 2, merged)
+}
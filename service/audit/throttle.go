@@ -0,0 +1,73 @@
+package audit
+
+/// 登录失败等可能被大量触发的操作， 同一来源每分钟只记录一条， 期间的次数合并到下一条日志中
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kataras/iris/v12"
+)
+
+const (
+	throttleWindow = time.Minute
+	maxThrottled   = 10000 // 超过后不再区分来源， 所有来源合并记录
+	anySource      = "*"
+)
+
+type throttleState struct {
+	from   time.Time // 当前窗口开始的时间
+	merged int       // 当前窗口内被合并的次数
+}
+
+type throttler struct {
+	lock   sync.Mutex
+	states map[string]*throttleState
+}
+
+var throttled = &throttler{states: make(map[string]*throttleState, defaultPageSize)}
+
+// hit 窗口内的第一次需要记录， 同时返回上个窗口被合并的次数， 其余的只计数
+func (t *throttler) hit(key string, now time.Time) (bool, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.states[key]; !ok && len(t.states) >= maxThrottled {
+		t.prune(now)
+		if len(t.states) >= maxThrottled {
+			key = anySource
+		}
+	}
+	s, ok := t.states[key]
+	if ok && now.Sub(s.from) < throttleWindow {
+		s.merged++
+		return false, 0
+	}
+	merged := 0
+	if ok {
+		merged = s.merged
+	}
+	t.states[key] = &throttleState{from: now}
+	return true, merged
+}
+
+// 清理已经过了窗口且没有被合并次数的来源
+func (t *throttler) prune(now time.Time) {
+	for k, s := range t.states {
+		if now.Sub(s.from) >= throttleWindow && s.merged == 0 {
+			delete(t.states, k)
+		}
+	}
+}
+
+// RecordThrottled 同一操作人与来源IP 每分钟只记录一条， 被合并的次数记录在下一条日志的 after 中
+func RecordThrottled(ctx iris.Context, actor, action, target string) {
+	record, merged := throttled.hit(action+"|"+actor+"|"+ctx.RemoteAddr(), time.Now())
+	if !record {
+		return
+	}
+	var after interface{}
+	if merged > 0 {
+		after = map[string]int{"merged": merged}
+	}
+	RecordAs(ctx, actor, action, target, nil, after)
+}
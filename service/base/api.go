@@ -20,3 +20,9 @@ func RouteStore(party iris.Party) {
 	party.Get("/key", get)
 	party.Get("/scan", scan)
 }
+
+func RouteAudit(party iris.Party) {
+	party.Use(app.RequireAdmin)
+	party.Get("/", queryAudit)
+	party.Get("/export", exportAudit)
+}
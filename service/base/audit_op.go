@@ -0,0 +1,25 @@
+package base
+
+/// 审计日志的查询与导出， 只有管理员可以访问
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gridsx/micro-conf/service/audit"
+	"github.com/kataras/iris/v12"
+	"github.com/winjeg/irisword/ret"
+)
+
+func queryAudit(ctx iris.Context) {
+	ret.Ok(ctx, audit.Search(audit.ReadQuery(ctx)))
+}
+
+// 以 JSON lines 的格式下载符合条件的全部日志
+func exportAudit(ctx iris.Context) {
+	ctx.ContentType("application/x-ndjson")
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=audit-%s.jsonl", time.Now().Format("20060102150405")))
+	if err := audit.Export(audit.ReadQuery(ctx), ctx.ResponseWriter()); err != nil {
+		ret.ServerError(ctx, err.Error())
+	}
+}
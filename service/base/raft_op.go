@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/gridsx/micro-conf/config"
+	"github.com/gridsx/micro-conf/service/audit"
 	"github.com/gridsx/micro-conf/store"
 	"github.com/gridsx/micro-conf/store/raft"
 	"github.com/kataras/iris/v12"
@@ -47,6 +48,9 @@ func clusterOperation(ctx iris.Context) {
 		ret.BadRequest(ctx, "wrong command")
 		return
 	}
+	if !audit.IsInner(ctx) {
+		audit.Record(ctx, "cluster."+cmd.Cmd, "node:"+cmd.NodeId, nil, cmd)
+	}
 	ret.Ok(ctx)
 }
 
@@ -4,6 +4,9 @@ package base
 /// 这些接口只在修复一些无法预料的bug的时候才使用， 需要对架构有清晰的认知
 
 import (
+	"strings"
+
+	"github.com/gridsx/micro-conf/service/audit"
 	"github.com/gridsx/micro-conf/store/raft"
 	"github.com/kataras/iris/v12"
 	"github.com/winjeg/irisword/ret"
@@ -14,6 +17,21 @@ type KeyCmd struct {
 	Key   string `json:"key,omitempty"`
 	Value string `json:"value,omitempty"`
 	Exp   int64  `json:"exp,omitempty"`
+	// 批量设置时使用
+	Kvs map[string]string `json:"kvs,omitempty"`
+}
+
+// touches 操作的key 中是否有符合条件的
+func (c *KeyCmd) touches(match func(key string) bool) bool {
+	if len(c.Key) > 0 && match(c.Key) {
+		return true
+	}
+	for k := range c.Kvs {
+		if match(k) {
+			return true
+		}
+	}
+	return false
 }
 
 func keyOperation(ctx iris.Context) {
@@ -23,10 +41,19 @@ func keyOperation(ctx iris.Context) {
 		ret.BadRequest(ctx)
 		return
 	}
-	if len(cmd.Key) == 0 || len(cmd.Cmd) == 0 {
+	if (len(cmd.Key) == 0 && cmd.Cmd != raft.CmdBatch) || len(cmd.Cmd) == 0 {
 		ret.BadRequest(ctx)
 		return
 	}
+	// 审计日志只能追加， 集群内部转发的写入除外（follower 上记录的审计日志会转发到leader）
+	if !audit.IsInner(ctx) && cmd.touches(audit.Protected) {
+		ret.BadRequest(ctx, "audit log can not be modified")
+		return
+	}
+	var before string
+	if !audit.IsInner(ctx) && cmd.Cmd != raft.CmdBatch {
+		before, _ = rs.Get(cmd.Key)
+	}
 
 	switch cmd.Cmd {
 	case raft.CmdDel:
@@ -39,6 +66,11 @@ func keyOperation(ctx iris.Context) {
 			ret.ServerError(ctx, err.Error())
 			return
 		}
+	case raft.CmdBatch:
+		if err := rs.SetBatch(cmd.Kvs); err != nil {
+			ret.ServerError(ctx, err.Error())
+			return
+		}
 	case raft.CmdSetEx:
 		if err := rs.Set(cmd.Key, cmd.Value, cmd.Exp); err != nil {
 			ret.ServerError(ctx, err.Error())
@@ -48,9 +80,39 @@ func keyOperation(ctx iris.Context) {
 		ret.BadRequest(ctx, "unknown cmd: "+cmd.Cmd)
 		return
 	}
+	auditKeyOperation(ctx, cmd, before)
 	ret.Ok(ctx)
 }
 
+// 集群内部转发的写请求不记录， 否则每次写入都会记录一遍， 审计日志本身的写入也会被转发过来
+func auditKeyOperation(ctx iris.Context, cmd *KeyCmd, before string) {
+	if audit.IsInner(ctx) {
+		return
+	}
+	target := "key:" + cmd.Key
+	if cmd.Cmd == raft.CmdBatch {
+		keys := make([]string, 0, len(cmd.Kvs))
+		for k := range cmd.Kvs {
+			keys = append(keys, k)
+		}
+		target = "keys:" + strings.Join(keys, ",")
+	}
+	// 底层存储的值可能包含token、密码等， 只记录摘要
+	var after interface{}
+	switch cmd.Cmd {
+	case raft.CmdDel:
+	case raft.CmdBatch:
+		digests := make(map[string]string, len(cmd.Kvs))
+		for k, v := range cmd.Kvs {
+			digests[k] = audit.Digest(v)
+		}
+		after = digests
+	default:
+		after = &KeyCmd{Cmd: cmd.Cmd, Key: cmd.Key, Value: audit.Digest(cmd.Value), Exp: cmd.Exp}
+	}
+	audit.Record(ctx, "store."+cmd.Cmd, target, audit.Digest(before), after)
+}
+
 func get(ctx iris.Context) {
 	key := ctx.URLParam("key")
 	val, err := rs.Get(key)
@@ -6,7 +6,6 @@ import (
 )
 
 func RouteInner(app *iris.Application) {
-	app.Post("/api/cfg/listen", acceptConfigChange)
 	app.Post("/api/cfg/app", appConfig)
 }
 
@@ -21,31 +20,38 @@ func routeAdminAPI(party iris.Party) {
 
 	// namespace 相关API -------------------------------------------------
 	// 获取所有namespace
-	party.Get("/app/{appId:string}/group/{groupId:string}/namespaces",
+	party.Get("/app/{appId:string}/group/{group:string}/namespaces",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Viewer) }, getNamespaces)
 	// 查看某namespace 配置
-	party.Get("/app/{appId:string}/group/{groupId:string}/namespace/{namespace:string}",
+	party.Get("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Viewer) }, getNamespaceContent)
 
 	// 查看某namespace 配置
-	party.Get("/app/{appId:string}/group/{groupId:string}/namespace/{namespace:string}",
+	party.Get("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Viewer) }, getNamespaceContent)
 
 	// 新增 namespace
-	party.Post("/app/{appId:string}/group/{groupId:string}/namespace",
+	party.Post("/app/{appId:string}/group/{group:string}/namespace",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Owner) },
-		func(ctx iris.Context) { namespaceOperation(ctx, createNamespace) })
+		func(ctx iris.Context) { namespaceOperation(ctx, "namespace.create", createNamespace) })
 	// 删除某namespace 配置
-	party.Delete("/app/{appId:string}/group/{groupId:string}/namespace",
+	party.Delete("/app/{appId:string}/group/{group:string}/namespace",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Owner) },
-		func(ctx iris.Context) { namespaceOperation(ctx, removeNamespace) })
+		func(ctx iris.Context) { namespaceOperation(ctx, "namespace.delete", removeNamespace) })
 	// namespace history
 	party.Get("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}/history",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Developer) }, namespaceEditHistory)
 	// 修改某namespace内容
 	party.Put("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Developer) }, changeNamespaceContent)
-	// 发布某namespace功能
+	// 发布前预览变更以及会影响到的实例
+	party.Get("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}/preview",
+		func(ctx iris.Context) { app.RequirePermission(ctx, app.Developer) }, previewRelease)
+	// namespace 当前发布在各实例上的生效情况
+	party.Get("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}/convergence",
+		func(ctx iris.Context) { app.RequirePermission(ctx, app.Viewer) }, namespaceConvergence)
+	// 发布某namespace功能， 可以通过 wait 参数等待指定比例的实例生效
 	party.Post("/app/{appId:string}/group/{group:string}/namespace/{namespace:string}/release",
 		func(ctx iris.Context) { app.RequirePermission(ctx, app.Owner) }, releaseNamespace)
+	// 回滚到某个历史发布
 }
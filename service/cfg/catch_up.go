@@ -0,0 +1,88 @@
+package cfg
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/gridsx/micro-conf/service/app"
+	"github.com/gridsx/micro-conf/service/conn"
+)
+
+func init() {
+	conn.HandleSync(catchUp)
+}
+
+// catchUp 客户端重连后上报自己持有的发布， 补推断开期间错过的发布
+// 差距不大的推送差异， 差距过大或者找不到对应历史版本的推送全量内容
+func catchUp(client *conn.Client, info *conn.HeartBeat) {
+	for v, held := range info.Releases {
+		appId, group, namespace := info.AppId, info.Group, v
+		if app.IsNsShared(v) {
+			appId, group, namespace = app.ExtractAppGroupNs(v)
+		}
+		release := app.FindRelease(appId, group, namespace)
+		if release == nil || release.Match(held) {
+			continue
+		}
+		current, err := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+		if err != nil {
+			continue
+		}
+		request := &ConfigChangeRequest{AppId: appId, Group: group, Release: release}
+		old, ok := heldContent(appId, group, namespace, held, release)
+		if !ok {
+			request.Full = true
+		}
+		nsDiff, err := releaseDiff(appId, group, namespace, old, current, request.Full)
+		if err != nil {
+			logger.Errorf("catchUp - diff namespace %s err: %s\n", v, err.Error())
+			continue
+		}
+		if nsDiff.Same && !request.Full {
+			continue
+		}
+		request.Diff = nsDiff
+		client.Deliver(func(c *conn.Client) { pushTo(c, request) })
+	}
+}
+
+// 全量推送时客户端持有的内容未知， 与空内容比较后， 再把历史版本中出现过而当前没有的key 作为删除推送
+// 老协议的客户端逐个key 应用， 否则断开期间删除的key 会一直残留在客户端
+func releaseDiff(appId, group, namespace, old, current string, full bool) (*NamespaceDiff, error) {
+	nsDiff, err := diff(namespace, old, current)
+	if err != nil || !full {
+		return nsDiff, err
+	}
+	if nsDiff.Removed == nil {
+		nsDiff.Removed = make(map[string]string, defaultSize)
+	}
+	for _, h := range queryNamespaceHistory(appId, group, namespace) {
+		historyDiff, err := diff(namespace, h.Content, current)
+		if err != nil {
+			continue
+		}
+		for k, v := range historyDiff.Removed {
+			nsDiff.Removed[k] = v
+		}
+	}
+	return nsDiff, nil
+}
+
+// 客户端持有的发布对应的内容， 差距太大或者找不到历史版本的时候返回false
+func heldContent(appId, group, namespace, held string, release *app.NamespaceRelease) (string, bool) {
+	heldRelease, err := strconv.ParseInt(held, 10, 64)
+	if err != nil || heldRelease >= release.Release || release.Release-heldRelease > maxCatchUpGap {
+		return "", false
+	}
+	return releaseContent(appId, group, namespace, heldRelease)
+}
+
+// 某个历史发布对应的内容， 历史记录按时间倒序， 同一个发布号取最近的
+func releaseContent(appId, group, namespace string, release int64) (string, bool) {
+	for _, h := range queryNamespaceHistory(appId, group, namespace) {
+		if h.Release == release {
+			return h.Content, true
+		}
+	}
+	return "", false
+}
@@ -9,29 +9,105 @@ import (
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/gridsx/micro-conf/service/app"
+	"github.com/gridsx/micro-conf/service/audit"
 	"github.com/gridsx/micro-conf/user/session"
 	json "github.com/json-iterator/go"
 	"github.com/kataras/iris/v12"
 	"github.com/winjeg/irisword/ret"
 )
 
-func namespaceOperation(ctx iris.Context, f func(req *NamespaceReq) error) {
+func namespaceOperation(ctx iris.Context, action string, f func(req *NamespaceReq) error) {
 	ns := new(NamespaceReq)
 	if err := ctx.ReadJSON(ns); err != nil {
 		ret.BadRequest(ctx, err.Error())
 		return
 	}
+	// 权限按路由中的app 与group 校验， 请求体中的不能与之不同
+	appId, group := ctx.Params().Get("appId"), ctx.Params().Get("group")
+	if (len(ns.AppId) > 0 && ns.AppId != appId) || (len(ns.Group) > 0 && ns.Group != group) {
+		ret.BadRequest(ctx, "appId or group does not match the route")
+		return
+	}
+	ns.AppId, ns.Group = appId, group
 	if err := f(ns); err != nil {
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	var after interface{}
+	if len(ns.Content) > 0 {
+		_, after = auditContent(ns.Namespace, "", ns.Content)
+	}
+	audit.Record(ctx, action, auditTarget(ns.AppId, ns.Group, ns.Namespace), nil, after)
 	ret.Ok(ctx)
 }
 
+func auditTarget(appId, group, namespace string) string {
+	return fmt.Sprintf("namespace:%s/%s/%s", appId, group, namespace)
+}
+
+// contentAudit 审计日志中不保存配置的内容， 只保存checksum 以及变化的配置项
+type contentAudit struct {
+	Checksum string   `json:"checksum"`
+	Added    []string `json:"added,omitempty"`
+	Removed  []string `json:"removed,omitempty"`
+	Changed  []string `json:"changed,omitempty"`
+}
+
+// 无法解析的格式只记录checksum
+func auditContent(namespace, before, after string) (*contentAudit, *contentAudit) {
+	b, a := &contentAudit{Checksum: app.Checksum(before)}, &contentAudit{Checksum: app.Checksum(after)}
+	d, err := diff(namespace, before, after)
+	if err != nil || d == nil {
+		return b, a
+	}
+	a.Added, a.Removed = sortedKeys(d.Added), sortedKeys(d.Removed)
+	for k := range d.Changed {
+		a.Changed = append(a.Changed, k)
+	}
+	sort.Strings(a.Changed)
+	return b, a
+}
+
+func sortedKeys(m map[string]string) []string {
+	result := make([]string, 0, len(m))
+	for k := range m {
+		result = append(result, k)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// 修改前的内容， 有待发布的取待发布的， 否则取当前生效的
+func draftContent(appId, group, namespace string) string {
+	if draft, err := rs.Get(fmt.Sprintf(appUnreleasedKeyPattern, appId, group, namespace)); err == nil {
+		return draft
+	}
+	current, _ := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+	return current
+}
+
 func createNamespace(ns *NamespaceReq) error {
 	if err := ns.Valid(); err != nil {
 		return err
 	}
+	if err := app.CheckNamespaceCount(ns.AppId); err != nil {
+		return err
+	}
+	content := ""
+	if len(ns.Template) > 0 {
+		tpl, err := app.FindTemplate(ns.Template)
+		if err != nil {
+			return errors.New("template does not exist")
+		}
+		tplNs := tpl.FindNamespace(ns.Group, ns.Namespace)
+		if tplNs == nil {
+			return errors.New("namespace not found in template")
+		}
+		content = tplNs.Render(app.TemplateVars(ns.AppId, ns.Group, ns.Namespace))
+		if err := app.CheckNamespaceSize(ns.AppId, content); err != nil {
+			return err
+		}
+	}
 
 	nsKey := fmt.Sprintf(appConfigKeyPattern, ns.AppId, ns.Group, ns.Namespace)
 	existed, err := rs.Get(nsKey)
@@ -42,7 +118,7 @@ func createNamespace(ns *NamespaceReq) error {
 		return errors.New("app already exists")
 	}
 	if errors.Is(err, badger.ErrKeyNotFound) {
-		if err := rs.Set(nsKey, "", -1); err != nil {
+		if err := rs.Set(nsKey, content, -1); err != nil {
 			return err
 		} else {
 			return nil
@@ -72,6 +148,9 @@ func removeNamespace(ns *NamespaceReq) error {
 	if err := rs.Delete(nsReleaseKey); err != nil {
 		logger.Errorln("removeNamespace - delete unreleased config error")
 	}
+	if err := rs.Delete(fmt.Sprintf(appReleaseKeyPattern, ns.AppId, ns.Group, ns.Namespace)); err != nil {
+		logger.Errorln("removeNamespace - delete release info error")
+	}
 
 	//历史版本比较多需要scan后删除
 	nsHistoryPrefix := fmt.Sprintf(appHistoryScanPattern, ns.AppId, ns.Group, ns.Namespace)
@@ -159,6 +238,54 @@ func getNamespaceContent(ctx iris.Context) {
 	ret.Ok(ctx, nsDiff)
 }
 
+// ReleasePreview 发布前的预览： 本次发布的变更， 以及会影响到的实例和其连接所在的节点
+type ReleasePreview struct {
+	Diff         *NamespaceDiff          `json:"diff"`
+	Instances    []*app.ImpactedInstance `json:"instances"`
+	Connected    int                     `json:"connected"`
+	Disconnected int                     `json:"disconnected"`
+	Nodes        map[string]int          `json:"nodes"` // 每个节点上连接着的实例数
+}
+
+func previewRelease(ctx iris.Context) {
+	appId := ctx.Params().Get("appId")
+	group := ctx.Params().Get("group")
+	namespace := ctx.Params().Get("namespace")
+	currentContent, err := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+	if err != nil {
+		ret.BadRequest(ctx, "namespace does not exist")
+		return
+	}
+	toReleaseContent, err := rs.Get(fmt.Sprintf(appUnreleasedKeyPattern, appId, group, namespace))
+	if err != nil {
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			ret.BadRequest(ctx, "no content to release")
+			return
+		}
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	nsDiff, err := diff(namespace, currentContent, toReleaseContent)
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	preview := &ReleasePreview{
+		Diff:      nsDiff,
+		Instances: app.NamespaceImpact(appId, group, namespace),
+		Nodes:     make(map[string]int, defaultSize),
+	}
+	for _, inst := range preview.Instances {
+		if inst.Connected {
+			preview.Connected++
+			preview.Nodes[inst.Node]++
+		} else {
+			preview.Disconnected++
+		}
+	}
+	ret.Ok(ctx, preview)
+}
+
 type namespaceChangeReq struct {
 	Content string `json:"content"`
 }
@@ -178,28 +305,36 @@ func changeNamespaceContent(ctx iris.Context) {
 		ret.BadRequest(ctx, "namespace does not exist")
 		return
 	}
+	if err := app.CheckNamespaceSize(appId, content.Content); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	before := draftContent(appId, group, namespace)
 	toRelease := fmt.Sprintf(appUnreleasedKeyPattern, appId, group, namespace)
 	if err := rs.Set(toRelease, content.Content, -1); err != nil {
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	auditBefore, auditAfter := auditContent(namespace, before, content.Content)
+	audit.Record(ctx, "namespace.edit", auditTarget(appId, group, namespace), auditBefore, auditAfter)
+	data := map[string]interface{}{"group": group, "namespace": namespace}
+	if userInfo := session.GetUserInfo(ctx); userInfo != nil {
+		data["modifiedBy"] = userInfo.Username
+	}
+	app.Notify(appId, app.HookDraft, data)
 	ret.Ok(ctx)
 }
 
-// 1. 新增历史数据
-// 2. 把toRelease 设置到 current
-// 3. 推送变更
-// 4. 把toRelease 删掉
+var errNothingChanged = errors.New("config same, nothing  changed!")
+
 func releaseNamespace(ctx iris.Context) {
 	appId := ctx.Params().Get("appId")
 	group := ctx.Params().Get("group")
 	namespace := ctx.Params().Get("namespace")
 	userInfo := session.GetUserInfo(ctx)
-	// 当前内容
-	currentKey := fmt.Sprintf(appConfigKeyPattern, appId, group, namespace)
-	currentContent, err := rs.Get(currentKey)
+	percent, err := waitPercent(ctx)
 	if err != nil {
-		ret.BadRequest(ctx, "namespace does not exist")
+		ret.BadRequest(ctx, err.Error())
 		return
 	}
 
@@ -215,48 +350,151 @@ func releaseNamespace(ctx iris.Context) {
 		return
 	}
 
-	// 当前与待发布进行比较
-	namespaceDiff, err := diff(namespace, currentContent, toReleaseContent)
+	before, _ := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+	release, err := publish(appId, group, namespace, toReleaseContent, userInfo.Username)
 	if err != nil {
+		if errors.Is(err, errNothingChanged) {
+			ret.Ok(ctx, err.Error())
+			return
+		}
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	app.Notify(appId, app.HookRelease, map[string]interface{}{"group": group, "namespace": namespace, "release": release})
+	auditBefore, auditAfter := auditContent(namespace, before, toReleaseContent)
+	audit.Record(ctx, "namespace.release", auditTarget(appId, group, namespace), auditBefore, auditAfter)
 
-	if namespaceDiff.Same {
-		ret.Ok(ctx, "config same, nothing  changed!")
+	// 删除待发布的key
+	if err := rs.Delete(toRelease); err != nil {
+		ret.ServerError(ctx, err.Error())
 		return
 	}
+	respondRelease(ctx, appId, group, namespace, release, percent)
+}
+
+// 1. 新增历史数据
+// 2. 把内容设置到 current
+// 3. 写入发布信息， 由各节点推送变更
+func publish(appId, group, namespace, content, username string) (*app.NamespaceRelease, error) {
+	// 当前内容
+	currentKey := fmt.Sprintf(appConfigKeyPattern, appId, group, namespace)
+	currentContent, err := rs.Get(currentKey)
+	if err != nil {
+		return nil, errors.New("namespace does not exist")
+	}
+
+	// 当前与待发布进行比较
+	namespaceDiff, err := diff(namespace, currentContent, content)
+	if err != nil {
+		return nil, err
+	}
+	if namespaceDiff.Same {
+		return nil, errNothingChanged
+	}
 
 	// 历史数据记录
 	now := time.Now()
+	lastRelease := app.FindRelease(appId, group, namespace)
 	editHistory := NamespaceEditHistory{
 		Time:       now,
-		ModifiedBy: userInfo.Username,
+		ModifiedBy: username,
 		Content:    currentContent,
+		Release:    lastRelease.Release,
 	}
 	historyKey := fmt.Sprintf(appHistoryKeyPattern, appId, group, namespace, now.Format(time.RFC3339))
 	d, jsonErr := json.Marshal(editHistory)
 	if jsonErr != nil {
-		ret.ServerError(ctx, jsonErr.Error())
-		return
+		return nil, jsonErr
 	}
 	if err := rs.Set(historyKey, string(d), -1); err != nil {
-		ret.ServerError(ctx, err.Error())
-		return
+		return nil, err
 	}
+	pruneHistory(appId, group, namespace)
 
-	if err := rs.Set(currentKey, toReleaseContent, -1); err != nil {
-		ret.ServerError(ctx, err.Error())
+	if err := rs.Set(currentKey, content, -1); err != nil {
+		return nil, err
+	}
+
+	// 发布号递增， 实例通过心跳上报持有的发布号， 用于统计生效情况
+	// 各节点的状态机应用发布信息后， 各自推送给连接在自己上的客户端
+	release := &app.NamespaceRelease{
+		Release:    lastRelease.Release + 1,
+		Checksum:   app.Checksum(content),
+		ReleasedBy: username,
+		Time:       now,
+	}
+	releaseKey := fmt.Sprintf(appReleaseKeyPattern, appId, group, namespace)
+	if err := rs.Set(releaseKey, release.String(), -1); err != nil {
+		return nil, err
+	}
+	return release, nil
+}
+
+// 只保留配额内的历史版本， 时间格式相同的key 按字典序即是时间顺序
+func pruneHistory(appId, group, namespace string) {
+	depth := app.HistoryDepth(appId)
+	if depth < 0 {
+		return
+	}
+	keys := rs.ScanKeys(fmt.Sprintf(appHistoryScanPattern, appId, group, namespace))
+	if len(keys) <= depth {
 		return
 	}
+	sort.Strings(keys)
+	for _, k := range keys[:len(keys)-depth] {
+		if err := rs.Delete(k); err != nil {
+			logger.Errorf("pruneHistory - delete %s err: %s\n", k, err.Error())
+		}
+	}
+}
 
-	// 推送变更内容
-	pushChange(appId, group, namespaceDiff)
+// 发布后等待生效的实例比例， 不传则不等待， 传了必须在1到100之间， 否则永远达不到
+func waitPercent(ctx iris.Context) (int, error) {
+	percent := ctx.URLParamIntDefault("wait", 0)
+	if ctx.URLParamExists("wait") && (percent < 1 || percent > 100) {
+		return 0, errors.New("wait should be between 1 and 100")
+	}
+	return percent, nil
+}
 
-	// 删除待发布的key
-	if err := rs.Delete(toRelease); err != nil {
-		ret.ServerError(ctx, err.Error())
+// 需要等待指定比例的实例生效后再返回
+func respondRelease(ctx iris.Context, appId, group, namespace string, release *app.NamespaceRelease, percent int) {
+	if percent > 0 {
+		conv := waitConvergence(appId, group, namespace, percent, ctx.URLParamIntDefault("timeout", defaultWaitSeconds))
+		if conv.Percent() < percent {
+			ret.BizError(ctx, "1003", fmt.Sprintf("released %d, but only %d%% instances applied", release.Release, conv.Percent()))
+			return
+		}
+		ret.Ok(ctx, conv)
 		return
 	}
 	ret.Ok(ctx)
 }
+
+// 轮询实例上报的发布号， 直到生效比例达到要求或者超时
+func waitConvergence(appId, group, namespace string, percent, timeout int) *app.Convergence {
+	if timeout <= 0 || timeout > maxWaitSeconds {
+		timeout = maxWaitSeconds
+	}
+	deadline := time.Now().Add(time.Second * time.Duration(timeout))
+	for {
+		conv, _ := app.NamespaceConvergence(appId, group, namespace)
+		if conv.Percent() >= percent || time.Now().After(deadline) {
+			return conv
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// 某namespace 当前发布在各个实例上的生效情况
+func namespaceConvergence(ctx iris.Context) {
+	appId := ctx.Params().Get("appId")
+	group := ctx.Params().Get("group")
+	namespace := ctx.Params().Get("namespace")
+	conv, instances := app.NamespaceConvergence(appId, group, namespace)
+	if conv.Release == nil {
+		ret.BadRequest(ctx, "namespace does not exist")
+		return
+	}
+	ret.Ok(ctx, map[string]interface{}{"convergence": conv, "instances": instances})
+}
@@ -1,174 +1,203 @@
 package cfg
 
 import (
-	"bytes"
 	"fmt"
-	"io"
-	"net/http"
 	"strconv"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/gridsx/micro-conf/service/app"
-	"github.com/gridsx/micro-conf/service/base"
 	"github.com/gridsx/micro-conf/service/conn"
 	"github.com/gridsx/micro-conf/store/raft"
 	jsoniter "github.com/json-iterator/go"
-	"github.com/kataras/iris/v12"
-	"github.com/winjeg/go-commons/log"
-	"github.com/winjeg/irisword/ret"
-)
-
-const (
-	waitClientReconnectTime = 30 // 等待客户端重连的时间
-	maxRetryCount           = 20 // 最大重试次数
 )
 
 type ConfigChangeRequest struct {
-	AppId string         `json:"appId,omitempty"`
-	Group string         `json:"group,omitempty"`
-	Diff  *NamespaceDiff `json:"diff,omitempty"`
+	AppId   string                `json:"appId,omitempty"`
+	Group   string                `json:"group,omitempty"`
+	Release *app.NamespaceRelease `json:"release,omitempty"`
+	Diff    *NamespaceDiff        `json:"diff,omitempty"`
+	Full    bool                  `json:"full,omitempty"` // 全量推送， 此时 Diff 是与空内容比较的结果， 另带有历史版本中已删除的key
 }
 
-// AcceptConfigChange  只允许集群内节点之间相互调用
-func acceptConfigChange(ctx iris.Context) {
-	req := new(ConfigChangeRequest)
-	if err := ctx.ReadJSON(req); err != nil {
-		ret.BadRequest(ctx)
-		return
+func (r *ConfigChangeRequest) releaseEvent() *NamespaceReleaseEvent {
+	event := &NamespaceReleaseEvent{
+		Namespace: fmt.Sprintf("%s.%s.%s", r.AppId, r.Group, r.Diff.Namespace),
+		Added:     r.Diff.Added,
+		Removed:   r.Diff.Removed,
+		Changed:   r.Diff.Changed,
 	}
-	doPush(req)
-	ret.Ok(ctx)
+	if r.Release != nil {
+		event.Release = r.Release.Release
+		event.Checksum = r.Release.Checksum
+	}
+	if r.Full {
+		event.Full = true
+		event.Content = r.Diff.Added
+		event.Added = nil
+	}
+	return event
 }
 
-// 根据namespace 获取监听的ip列表
-// 针对每个监听的ip列表进行push
-// 如果自己不是Leader的话， 那么需要把消息打包发给其他节点，等待其他节点ack
-func pushChange(appId, group string, diff *NamespaceDiff) {
-	request := &ConfigChangeRequest{
-		AppId: appId,
-		Group: group,
-		Diff:  diff,
-	}
-	// 先把连接到自己这边的push一遍
-	doPush(request)
-	// 然后把消息存起来， 发给每个节点
-	info := base.GetClusterInfo()
-	if info == nil || len(info.Peers) == 0 {
-		log.GetLogger(nil).Errorln("pushChange - error getting cluster info")
-	} else {
-		// 针对每个节点，进行变化转发， 转发后， 接收到消息的节点，找出自己本地；连接的应用，并把变化推送出去
-		for _, p := range info.Peers {
-			if base.IsSelf() {
-				continue
-			}
-			go func() {
-				if sendFollowerChange(p, request) {
-					return
-				}
-				for i := 0; i <= maxRetryCount; i++ {
-					time.Sleep(time.Second * time.Duration(i))
-					if sendFollowerChange(p, request) {
-						break
-					}
-				}
-			}()
-		}
+// 本节点上每个namespace 最近推送过的发布号， 通过快照追上leader 时可能跳过了多个发布， 需要从这里开始计算差异
+var (
+	pushedLock sync.Mutex
+	pushed     = make(map[string]int64, defaultSize)
+)
+
+func init() {
+	rs.Watch(appReleaseScanPattern, onRelease)
+}
+
+// 记录本次推送的发布号， 返回上次推送的， 没有推送过的为上一个发布， 已经推送过的返回false
+func markPushed(key string, release int64) (int64, bool) {
+	pushedLock.Lock()
+	defer pushedLock.Unlock()
+	last, ok := pushed[key]
+	if ok && last >= release {
+		return last, false
+	}
+	if !ok {
+		last = release - 1
 	}
+	pushed[key] = release
+	return last, true
 }
 
-// 发送成功则不存储，发送失败，存储下来，用于后续重发
-func sendFollowerChange(p raft.PeerState, request *ConfigChangeRequest) bool {
-	arr := strings.Split(p.Addr, ":")
-	raftPort, _ := strconv.Atoi(arr[1])
-	data, err := jsoniter.Marshal(request)
-	if err != nil {
-		log.GetLogger(nil).Errorln("sendFollowerChange - json err: " + err.Error())
+// onRelease 每个节点的状态机应用了发布信息后， 各自推送给连接在自己上的客户端
+// 发布时历史版本与当前内容先于发布信息写入， 因此这里可以直接计算出本次发布的差异
+// 回调是异步的， 连续发布时当前内容可能已经是下一次发布的， 因此使用与发布号对应的历史内容
+// 差异从本节点上次推送的发布开始计算， 通过快照追上leader 时跳过的发布也会包含在内
+func onRelease(op, key, value string) {
+	if op == raft.CmdDel {
+		// namespace 删除后重新创建的， 发布号重新开始
+		pushedLock.Lock()
+		delete(pushed, key)
+		pushedLock.Unlock()
+		return
+	}
+	release := new(app.NamespaceRelease)
+	if err := jsoniter.Unmarshal([]byte(value), release); err != nil {
+		logger.Errorf("onRelease - release info of %s err: %s\n", key, err.Error())
+		return
 	}
-	url := fmt.Sprintf("http://%s:%d/api/cfg/listen", arr[0], raftPort-1000)
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(data))
+	arr := strings.SplitN(strings.TrimPrefix(key, appReleaseScanPattern), ".", 3)
+	if len(arr) != 3 {
+		return
+	}
+	appId, group, namespace := arr[0], arr[1], arr[2]
+	current, ok := publishedContent(appId, group, namespace, release)
+	if !ok {
+		logger.Warnf("onRelease - content of %s release %d not found, skipped\n", key, release.Release)
+		return
+	}
+	request := &ConfigChangeRequest{AppId: appId, Group: group, Release: release}
+	last, fresh := markPushed(key, release.Release)
+	if !fresh {
+		return
+	}
+	old, ok := heldContent(appId, group, namespace, strconv.FormatInt(last, 10), release)
+	if !ok {
+		request.Full = true
+	}
+	nsDiff, err := releaseDiff(appId, group, namespace, old, current, request.Full)
 	if err != nil {
-		log.GetLogger(nil).Errorln("sendFollowerChange - http err: " + err.Error())
+		logger.Errorf("onRelease - diff namespace %s err: %s\n", key, err.Error())
+		return
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.GetLogger(nil).Errorf("sendFollowerChange - http err, code : %d\n", resp.StatusCode)
+	if nsDiff.Same && !request.Full {
+		return
 	}
-	respData, err := io.ReadAll(resp.Body)
-	responseData := new(ret.Ret)
-	if err := jsoniter.Unmarshal(respData, responseData); err != nil {
-		log.GetLogger(nil).Errorf("sendFollowerChange - json unmarshal err: %s\n", err.Error())
+	request.Diff = nsDiff
+	doPush(request)
+}
+
+// 本次发布的内容， 优先取历史版本中记录的， 找不到的时候当前内容的checksum 需要与发布一致
+func publishedContent(appId, group, namespace string, release *app.NamespaceRelease) (string, bool) {
+	if content, ok := releaseContent(appId, group, namespace, release.Release); ok {
+		return content, true
 	}
-	if responseData.Code == "0" {
-		return true
+	current, err := rs.Get(fmt.Sprintf(appConfigKeyPattern, appId, group, namespace))
+	if err != nil || app.Checksum(current) != release.Checksum {
+		return "", false
 	}
-	return false
+	return current, true
 }
 
+// 放入各个客户端的发送队列后即返回， 不等待投递完成
+// 正在重连的客户端由其队列暂存， 连接在其他节点上的由其他节点推送
 func doPush(request *ConfigChangeRequest) {
 	appId, group, diff := request.AppId, request.Group, request.Diff
 	instances := app.GetNamespaceInstances(appId, group, diff.Namespace)
+	owners := app.InstanceOwners()
 	for _, inst := range instances {
-		wsKey := fmt.Sprintf(app.ClientKeyFormat, appId, inst.IP, inst.Port)
-		client := conn.GetClient(wsKey)
-		// 如果client断开，30秒内重新连上是没关系的
-		if client == nil {
-			for i := 0; i < waitClientReconnectTime; i++ {
-				time.Sleep(time.Second)
-				client = conn.GetClient(wsKey)
-				if client != nil {
-					break
-				}
-			}
+		// 共享的namespace， 客户端连接的key 是使用方的app
+		clientApp := appId
+		if owner, ok := owners[fmt.Sprintf("%s:%d", inst.IP, inst.Port)]; ok {
+			clientApp = owner.App
 		}
+		wsKey := fmt.Sprintf(app.ClientKeyFormat, clientApp, inst.IP, inst.Port)
+		conn.Deliver(wsKey, func(c *conn.Client) { pushTo(c, request) })
+	}
+}
 
-		if client != nil {
-			if len(diff.Added) > 0 {
-				for k, v := range diff.Added {
-					event := &ConfigChangeEvent{
-						Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
-						Key:       k,
-						Type:      ConfigAdd,
-						Current:   v,
-					}
-					appEvent := app.AppEvent{
-						Type:    app.ConfigChange,
-						Content: event,
-					}
-					client.Send(appEvent.String())
-				}
+func pushTo(client *conn.Client, request *ConfigChangeRequest) {
+	// 协商了批量协议的客户端， 一次发布只推送一条完整的变更
+	if client.Protocol() >= conn.ProtocolBatch {
+		client.Push(&app.AppEvent{Type: app.ReleaseChange, Content: request.releaseEvent()})
+		return
+	}
+	pushKeyEvents(client, request)
+}
+
+// 老的协议， 每个变动的key单独推送一条消息
+func pushKeyEvents(client *conn.Client, request *ConfigChangeRequest) {
+	diff := request.Diff
+	if len(diff.Added) > 0 {
+		for k, v := range diff.Added {
+			event := &ConfigChangeEvent{
+				Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
+				Key:       k,
+				Type:      ConfigAdd,
+				Current:   v,
+			}
+			appEvent := app.AppEvent{
+				Type:    app.ConfigChange,
+				Content: event,
+			}
+			client.Push(&appEvent)
+		}
+	}
+	if len(diff.Removed) > 0 {
+		for k, v := range diff.Removed {
+			event := &ConfigChangeEvent{
+				Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
+				Key:       k,
+				Type:      ConfigRemove,
+				Current:   v,
 			}
-			if len(diff.Removed) > 0 {
-				for k, v := range diff.Removed {
-					event := &ConfigChangeEvent{
-						Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
-						Key:       k,
-						Type:      ConfigRemove,
-						Current:   v,
-					}
-					appEvent := app.AppEvent{
-						Type:    app.ConfigChange,
-						Content: event,
-					}
-					client.Send(appEvent.String())
-				}
+			appEvent := app.AppEvent{
+				Type:    app.ConfigChange,
+				Content: event,
 			}
+			client.Push(&appEvent)
+		}
+	}
 
-			if len(diff.Changed) > 0 {
-				for k, v := range diff.Changed {
-					event := &ConfigChangeEvent{
-						Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
-						Key:       k,
-						Type:      ConfigChange,
-						Current:   v.Right,
-						Before:    v.Left,
-					}
-					appEvent := app.AppEvent{
-						Type:    app.ConfigChange,
-						Content: event,
-					}
-					client.Send(appEvent.String())
-				}
+	if len(diff.Changed) > 0 {
+		for k, v := range diff.Changed {
+			event := &ConfigChangeEvent{
+				Namespace: fmt.Sprintf("%s.%s.%s", request.AppId, request.Group, diff.Namespace),
+				Key:       k,
+				Type:      ConfigChange,
+				Current:   v.Right,
+				Before:    v.Left,
+			}
+			appEvent := app.AppEvent{
+				Type:    app.ConfigChange,
+				Content: event,
 			}
+			client.Push(&appEvent)
 		}
 	}
 }
@@ -24,10 +24,19 @@ const (
 	appHistoryKeyPattern    = "app.cfg.history.%s.%s.%s.%s" // 历史版本 每个版本会额外再添加时间
 	appHistoryScanPattern   = "app.cfg.history.%s.%s.%s."
 	appConfigKeyScanPattern = "app.cfg.current.%s.%s."
+	appReleaseKeyPattern    = "app.cfg.release.%s.%s.%s" // 当前发布的发布号及checksum
+	appReleaseScanPattern   = "app.cfg.release."
+
+	// 发布后等待实例生效的时长， 单位秒
+	defaultWaitSeconds = 30
+	maxWaitSeconds     = 120
+
+	// 客户端重连补推时， 落后超过此数量的发布则直接推送全量内容
+	maxCatchUpGap = 10
 )
 
 var (
-	namePattern, _ = regexp.Compile("[a-zA-Z\\d\\-_]+")
+	namePattern, _ = regexp.Compile("^[a-zA-Z\\d\\-_]+$")
 	rs             = store.GetRaftStore()
 
 	logger = log.GetLogger(nil)
@@ -42,6 +51,7 @@ type NamespaceReq struct {
 	Group     string `json:"group,omitempty"`
 	Namespace string `json:"namespace,omitempty"`
 	Content   string `json:"content,omitempty"`
+	Template  string `json:"template,omitempty"` // 以模板中同名的namespace 内容作为初始内容
 }
 
 func (ns *NamespaceReq) Valid() error {
@@ -72,6 +82,7 @@ type NamespaceEditHistory struct {
 	Time       time.Time `json:"time"`
 	ModifiedBy string    `json:"modifiedBy,omitempty"`
 	Content    string    `json:"content,omitempty"`
+	Release    int64     `json:"release"` // Content 对应的发布号
 }
 
 func (n NamespaceHistory) Len() int {
@@ -21,6 +21,19 @@ type ConfigChangeEvent struct {
 	Before    string           `json:"before,omitempty"`
 }
 
+// NamespaceReleaseEvent 一次发布的完整变更， 带上发布号与checksum， 客户端可以整体原子的应用
+// Full 为true的时候， Content 是namespace 的全量内容， 客户端需要整体替换
+type NamespaceReleaseEvent struct {
+	Namespace string                `json:"namespace,omitempty"`
+	Release   int64                 `json:"release"`
+	Checksum  string                `json:"checksum,omitempty"`
+	Full      bool                  `json:"full,omitempty"`
+	Content   map[string]string     `json:"content,omitempty"`
+	Added     map[string]string     `json:"added,omitempty"`
+	Removed   map[string]string     `json:"removed,omitempty"`
+	Changed   map[string]StringPair `json:"changed,omitempty"`
+}
+
 type NamespaceDiff struct {
 	Namespace string                `json:"namespace,omitempty"`
 	Same      bool                  `json:"same,omitempty"`
@@ -44,7 +57,7 @@ func diff(namespace, old, new string) (*NamespaceDiff, error) {
 		oldMap, err = YamlToFlatMap(old)
 		newMap, err = YamlToFlatMap(new)
 	case typeJson:
-		oldMap, err = JsonToFlatMap(new)
+		oldMap, err = JsonToFlatMap(old)
 		newMap, err = JsonToFlatMap(new)
 	case typeProps:
 		oldMap, err = PropertiesToMap(old)
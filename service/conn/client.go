@@ -2,10 +2,13 @@ package conn
 
 import (
 	"encoding/json"
+	"errors"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/gridsx/micro-conf/config"
+	"github.com/gridsx/micro-conf/service/app"
 	"github.com/winjeg/go-commons/log"
 )
 
@@ -25,15 +28,67 @@ const (
 	pingPeriod = pongWait / 3
 
 	// Maximum message size allowed from peer.
-	maxMessageSize = 512
+	// 心跳带有每个namespace 持有的发布， 监听的namespace 较多时消息较长
+	maxMessageSize = 64 * 1024
+
+	// 上行消息的类型， 没有type的均视为心跳
+	msgAck       = "ack"
+	msgSync      = "sync"      // 格式与心跳一致， 上报持有的发布， 用于补推
+	msgSubscribe = "subscribe" // 订阅服务实例的变化
 )
 
+var errHeartbeatRate = errors.New("quota exceeded: heartbeat rate, heartbeat ignored")
+
 type Client struct {
-	conn   *websocket.Conn
-	send   chan []byte
-	key    string
-	lock   sync.Mutex
-	closed bool
+	conn       *websocket.Conn
+	send       chan []byte
+	key        string
+	lock       sync.Mutex
+	closed     bool
+	protocol   int
+	session    *session
+	synced     bool
+	since      time.Time
+	token      string    // 建立连接时使用的token 指纹
+	credential string    // 使用命名凭证连接的， 凭证的名称
+	scopes     []string  // 使用凭证连接的， 凭证的范围
+	beatFrom   time.Time // 当前心跳计数窗口的开始时间
+	beats      int       // 当前窗口内处理的心跳数
+	connAt     time.Time // 上次写入连接记录的时间
+}
+
+type upMessage struct {
+	Type     string            `json:"type,omitempty"`
+	Seq      uint64            `json:"seq,omitempty"`
+	Services []SvcSubscription `json:"services,omitempty"`
+}
+
+func (c *Client) Protocol() int {
+	return c.protocol
+}
+
+// Deliver 放入此客户端的发送队列， 与其他推送保持顺序
+func (c *Client) Deliver(d Delivery) {
+	c.session.enqueue(d)
+}
+
+// Push 按照客户端协商的协议推送事件， 需要确认的协议会分配序号并等待客户端ack
+func (c *Client) Push(e *app.AppEvent) {
+	if c.protocol < ProtocolAck {
+		c.Send(e.String())
+		return
+	}
+	c.Send(c.session.track(e))
+}
+
+// sendError 上行消息被拒绝时告知客户端， 不需要确认
+func (c *Client) sendError(err error) {
+	e := &app.AppEvent{Type: app.ErrorEvent, Content: map[string]string{"message": err.Error()}}
+	if c.protocol < ProtocolAck {
+		c.Send(e.String())
+		return
+	}
+	c.Send(e.JSON())
 }
 
 func (c *Client) Send(msg string) {
@@ -73,16 +128,80 @@ func (c *Client) Read() {
 			}
 			break
 		}
-		info := new(HeartBeat)
-		jsonErr := json.Unmarshal(message, info)
-		if jsonErr != nil {
+		msg := new(upMessage)
+		if jsonErr := json.Unmarshal(message, msg); jsonErr != nil {
 			logger.Warningln("websocket failed to unmarshal message: " + string(message))
-		} else {
-			routeHeartbeat(info)
+			continue
+		}
+		if msg.Type == msgAck {
+			c.session.ack(msg.Seq)
+			continue
+		}
+		if msg.Type == msgSubscribe {
+			c.subscribe(msg.Services)
+			continue
+		}
+		info := new(HeartBeat)
+		if jsonErr := json.Unmarshal(message, info); jsonErr != nil {
+			logger.Warningln("websocket failed to unmarshal heartbeat: " + string(message))
+			continue
+		}
+		cfgRead := app.HasScope(c.scopes, app.ScopeCfgRead)
+		if msg.Type == msgSync {
+			if cfgRead {
+				c.sync(info)
+			}
+			continue
+		}
+		// 超过配额频率的心跳不处理， 并告知客户端
+		if !c.allowBeat(app.HeartbeatRate(info.AppId)) {
+			c.sendError(errHeartbeatRate)
+			continue
+		}
+		if err := routeHeartbeat(info, app.HasScope(c.scopes, app.ScopeSvcRegister), cfgRead); err != nil {
+			c.sendError(err)
+		}
+		c.refreshConn()
+		// 连接后的第一个带有发布信息的心跳， 补推断开期间错过的发布
+		if cfgRead && !c.synced && len(info.Releases) > 0 {
+			c.sync(info)
 		}
 	}
 }
 
+// SyncHandler 客户端上报自己持有的发布后， 由配置模块补推缺失的变更
+type SyncHandler func(c *Client, info *HeartBeat)
+
+var syncHandler SyncHandler
+
+// HandleSync 注册补推的处理逻辑
+func HandleSync(h SyncHandler) {
+	syncHandler = h
+}
+
+// 按分钟计数， 每分钟最多处理rate 个心跳， rate 小于等于0 不限制
+// 只在读协程中调用， 无需加锁
+func (c *Client) allowBeat(rate int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if time.Since(c.beatFrom) >= time.Minute {
+		c.beatFrom, c.beats = time.Now(), 0
+	}
+	if c.beats >= rate {
+		return false
+	}
+	c.beats++
+	return true
+}
+
+func (c *Client) sync(info *HeartBeat) {
+	c.synced = true
+	if syncHandler != nil && len(info.AppId) > 0 {
+		syncHandler(c, info)
+	}
+}
+
 func (c *Client) Write() {
 	ticker := time.NewTicker(pingPeriod)
 	defer func() { ticker.Stop(); c.Close() }()
@@ -145,6 +264,10 @@ func (c *Client) Close() {
 	c.lock.Unlock()
 	close(c.send)
 	unregisterClient(c)
+	c.session.detach(c)
+	if err := app.RemoveConn(c.key, config.App.Raft.PeerId, c.since); err != nil {
+		logger.Warnf("websocket client %s remove conn err: %s\n", c.key, err.Error())
+	}
 	err := c.conn.Close()
 	if err != nil {
 		logger.Warnf("websocket connection close err: %s\n", err.Error())
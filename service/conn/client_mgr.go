@@ -1,15 +1,29 @@
 package conn
 
+import "sync"
+
+var (
+	clients    = make(map[string]*Client, 16)
+	clientLock sync.RWMutex
+)
+
 func GetClient(key string) *Client {
+	clientLock.RLock()
+	defer clientLock.RUnlock()
 	return clients[key]
 }
 
-var clients = make(map[string]*Client, 16)
-
 func registerClient(c *Client) {
+	clientLock.Lock()
+	defer clientLock.Unlock()
 	clients[c.key] = c
 }
 
+// 重连的时候旧连接的关闭可能晚于新连接的注册， 此时不能把新连接删掉
 func unregisterClient(c *Client) {
-	delete(clients, c.key)
+	clientLock.Lock()
+	defer clientLock.Unlock()
+	if clients[c.key] == c {
+		delete(clients, c.key)
+	}
 }
@@ -21,7 +21,8 @@ type HeartBeat struct {
 	EnableSvc  bool              `json:"enableSvc"`
 	EnableCfg  bool              `json:"enableCfg"`
 	Meta       map[string]string `json:"meta,omitempty"`
-	Namespaces []string          `json:"namespaces"` //此实例监听了哪些 配置文件， 如果是自己的话，取自己的appId和group， 如果是他人的，则取他人的
+	Namespaces []string          `json:"namespaces"`         //此实例监听了哪些 配置文件， 如果是自己的话，取自己的appId和group， 如果是他人的，则取他人的
+	Releases   map[string]string `json:"releases,omitempty"` // 每个namespace 当前持有的发布号或者内容checksum， key 与 namespaces 中的一致
 	Timeout    int64             `json:"timeout,omitempty"`
 }
 
@@ -41,6 +42,14 @@ func (b *HeartBeat) Valid() error {
 	return nil
 }
 
+// 心跳的超时时间， 未设置或者过小的默认10秒
+func (b *HeartBeat) timeout() int64 {
+	if b.Timeout < int64(time.Second) {
+		return int64(time.Second * 10)
+	}
+	return b.Timeout
+}
+
 func (b *HeartBeat) InstanceKey() string {
 	return fmt.Sprintf(app.InstPattern, b.AppId, b.Group, b.IP, b.Port)
 }
@@ -57,20 +66,32 @@ func (b *HeartBeat) MetaString() string {
 	return string(d)
 }
 
-func routeHeartbeat(info *HeartBeat) {
+// 凭证没有注册服务范围的不维持实例， 没有读取配置范围的不维持配置监听
+// 返回的错误需要告知客户端， 如心跳内容不合法或者超出实例数配额
+func routeHeartbeat(info *HeartBeat, register, cfgRead bool) error {
 	// 首先把app的心跳给搞起来，凡是连接了这个app的，都安排上
 	if err := info.Valid(); err != nil {
 		logger.WithField("err", err.Error()).Errorln("routeHeartbeat - payload err")
-		return
+		return err
+	}
+	// 已经删除的app， 不再维持其实例与监听
+	if a, _ := app.FindApp(info.AppId); a == nil {
+		return errors.New("app does not exist")
+	}
+	var err error
+	if register {
+		err = setAppHeartBeat(info)
 	}
-	setAppHeartBeat(info)
-	setCfgNsHeartBeat(info)
+	if cfgRead {
+		setCfgNsHeartBeat(info)
+	}
+	return err
 }
 
 // 维护两个KEY： 一个是meta， 另外一个是 inst
 // 本身并不需要改KEY对应的内容， 如果对应内容不存在的时候，由heartbeat 的内容进行填充
 // instance key 是跟app相连的，  metaKey 则是为了维持起来用作其他功能
-func setAppHeartBeat(info *HeartBeat) {
+func setAppHeartBeat(info *HeartBeat) error {
 	// 拿到meta， 更新meta过期时间
 	metaKey := info.MetaKey()
 	metaVal, metaErr := rs.Get(metaKey)
@@ -85,42 +106,53 @@ func setAppHeartBeat(info *HeartBeat) {
 	}
 	// 拿到 instance， 更新instance过期时间， 如果instance没有，则默认更新为UP
 	instanceKey := info.InstanceKey()
-	instanceState, _ := rs.Get(instanceKey)
-	// 根据 instance state 判断是否注册了服务
-	if info.EnableSvc {
-		if len(instanceState) == 0 {
-			instanceState = app.StateUp
+	before, _ := rs.Get(instanceKey)
+	if len(before) == 0 {
+		if err := app.CheckInstances(info.AppId, instanceKey); err != nil {
+			logger.Warnf("setAppHeartBeat - %s: %s\n", instanceKey, err.Error())
+			return err
 		}
-	} else {
-		instanceState = app.StateDisabled
 	}
-	timeout := info.Timeout
-	if info.Timeout < int64(time.Second) {
-		timeout = int64(time.Second * 10)
+	// 开启服务的心跳只维持已有的状态， 新的实例为UP， 关闭服务的为DISABLED
+	reported := ""
+	if !info.EnableSvc {
+		reported = app.StateDisabled
+	} else if len(before) == 0 {
+		reported = app.StateUp
+	}
+	// 人工设置过状态的， 心跳不能改变， 只记下上报的状态
+	instanceState := app.EffectiveState(info.AppId, info.Group, info.IP, info.Port, reported)
+	if len(instanceState) == 0 {
+		instanceState = before
 	}
-	if err := rs.Set(instanceKey, instanceState, timeout); err != nil {
+	if err := rs.Set(instanceKey, instanceState, info.timeout()); err != nil {
 		logger.Errorln("setAppHeartBeat- set state error: " + err.Error())
+		return nil
 	}
+	app.InstanceStateChanged(info.AppId, info.Group, info.IP, info.Port, before, instanceState)
+	return nil
 }
 
 func setCfgNsHeartBeat(info *HeartBeat) {
 	if !info.EnableCfg {
 		return
 	}
-	timeout := info.Timeout
-	if info.Timeout < int64(time.Second) {
-		timeout = int64(time.Second * 10)
-	}
+	timeout := info.timeout()
 	for _, v := range info.Namespaces {
-		var nsKey string
+		appId, group, ns := info.AppId, info.Group, v
 		if app.IsNsShared(v) {
-			appId, group, ns := app.ExtractAppGroupNs(v)
-			nsKey = fmt.Sprintf(app.NamespacePattern, appId, group, ns, info.IP, info.Port)
-		} else {
-			nsKey = fmt.Sprintf(app.NamespacePattern, info.AppId, info.Group, v, info.IP, info.Port)
+			appId, group, ns = app.ExtractAppGroupNs(v)
 		}
+		nsKey := fmt.Sprintf(app.NamespacePattern, appId, group, ns, info.IP, info.Port)
 		if err := rs.Set(nsKey, app.StateUp, timeout); err != nil {
 			logger.Errorln("setCfgNsHeartBeat - set app ns state failed, err: " + err.Error())
 		}
+		// 上报了持有的发布， 用于统计发布的生效情况
+		if release := info.Releases[v]; len(release) > 0 {
+			appliedKey := fmt.Sprintf(app.AppliedPattern, appId, group, ns, info.IP, info.Port)
+			if err := rs.Set(appliedKey, release, timeout); err != nil {
+				logger.Errorln("setCfgNsHeartBeat - set app ns release failed, err: " + err.Error())
+			}
+		}
 	}
 }
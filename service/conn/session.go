@@ -0,0 +1,224 @@
+package conn
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gridsx/micro-conf/service/app"
+)
+
+// 客户端连接时通过参数 protocol 协商推送消息的格式
+const (
+	ProtocolLegacy = 0 // 消息为 内容json + 类型字节， 无需确认
+	ProtocolAck    = 1 // 消息为带序号的json， 客户端需要ack， 未确认的会重发
+	ProtocolBatch  = 2 // 在 ProtocolAck 的基础上， 一次发布只推送一条包含完整变更的消息
+
+	ackTimeout        = 5 * time.Second // 超过此时长未确认则重发
+	maxRedeliverCount = 10              // 重发次数上限， 超过则丢弃
+	sessionExpire     = 5 * time.Minute // 客户端断开后会话的保留时长， 期间重连可继续投递
+	maxQueueSize      = 256             // 每个客户端待投递队列的容量， 满了则丢弃最早的
+)
+
+// Delivery 一次待投递的推送， 投递时才拿到当前连接的客户端， 以便按其协议决定消息格式
+type Delivery func(c *Client)
+
+type pendingEvent struct {
+	seq     uint64
+	msg     string
+	sentAt  time.Time
+	retries int
+}
+
+// session 以客户端的key为维度， 保存待投递的队列、推送的序号以及未确认的消息
+// 客户端断开重连后沿用同一个session， 断开期间的推送会等待其重连后投递， 未确认的消息会重新投递
+type session struct {
+	key      string
+	lock     sync.Mutex
+	seq      uint64
+	pending  map[uint64]*pendingEvent
+	client   *Client
+	closedAt time.Time
+	queue    chan Delivery
+	done     chan struct{}
+	services []SvcSubscription // 订阅的服务
+}
+
+var (
+	sessions    = make(map[string]*session, 16)
+	sessionLock sync.Mutex
+)
+
+func init() {
+	go redeliverLoop()
+}
+
+func attachSession(c *Client) *session {
+	sessionLock.Lock()
+	s, ok := sessions[c.key]
+	if !ok {
+		s = &session{
+			key:     c.key,
+			pending: make(map[uint64]*pendingEvent, 16),
+			queue:   make(chan Delivery, maxQueueSize),
+			done:    make(chan struct{}),
+		}
+		sessions[c.key] = s
+		go s.deliverLoop()
+	}
+	sessionLock.Unlock()
+
+	s.lock.Lock()
+	s.client = c
+	s.lock.Unlock()
+	return s
+}
+
+// Deliver 把推送放入客户端的队列中异步投递， 不会阻塞调用方
+// 本节点上没有此客户端（从未连接过或者断开过久）的返回false
+func Deliver(key string, d Delivery) bool {
+	sessionLock.Lock()
+	s, ok := sessions[key]
+	sessionLock.Unlock()
+	if !ok {
+		return false
+	}
+	s.enqueue(d)
+	return true
+}
+
+func (s *session) enqueue(d Delivery) {
+	select {
+	case s.queue <- d:
+		return
+	default:
+	}
+	// 队列满了， 丢弃最早的一条
+	select {
+	case <-s.queue:
+		logger.Warnf("deliver - client %s queue full, oldest delivery dropped\n", s.key)
+	default:
+	}
+	select {
+	case s.queue <- d:
+	default:
+		logger.Warnf("deliver - client %s queue full, delivery dropped\n", s.key)
+	}
+}
+
+func (s *session) current() *Client {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client
+}
+
+func (s *session) deliverLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case d := <-s.queue:
+			s.deliver(d)
+		}
+	}
+}
+
+// 客户端正在重连的， 等待其连上后再投递， 会话过期则放弃
+func (s *session) deliver(d Delivery) {
+	for {
+		if c := s.current(); c != nil {
+			d(c)
+			return
+		}
+		select {
+		case <-s.done:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func (s *session) detach(c *Client) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.client == c {
+		s.client = nil
+		s.closedAt = time.Now()
+	}
+}
+
+func (s *session) expired() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.client == nil && time.Since(s.closedAt) > sessionExpire
+}
+
+// track 给消息分配序号， 并记录为待确认
+func (s *session) track(e *app.AppEvent) string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.seq++
+	event := *e
+	event.Seq = s.seq
+	msg := event.JSON()
+	s.pending[s.seq] = &pendingEvent{seq: s.seq, msg: msg, sentAt: time.Now()}
+	return msg
+}
+
+func (s *session) ack(seq uint64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.pending, seq)
+}
+
+// redeliver 重发超时未确认的消息， all 为true 时（比如刚重连上）全部重发
+func (s *session) redeliver(all bool) {
+	s.lock.Lock()
+	client := s.client
+	if client == nil {
+		s.lock.Unlock()
+		return
+	}
+	now := time.Now()
+	events := make([]*pendingEvent, 0, len(s.pending))
+	for seq, p := range s.pending {
+		if !all && now.Sub(p.sentAt) < ackTimeout {
+			continue
+		}
+		if p.retries >= maxRedeliverCount {
+			logger.Warnf("redeliver - client %s never acked event %d, dropped\n", s.key, seq)
+			delete(s.pending, seq)
+			continue
+		}
+		p.retries++
+		p.sentAt = now
+		events = append(events, p)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(events, func(i, j int) bool { return events[i].seq < events[j].seq })
+	for _, p := range events {
+		client.Send(p.msg)
+	}
+}
+
+func redeliverLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		sessionLock.Lock()
+		active := make([]*session, 0, len(sessions))
+		for k, s := range sessions {
+			if s.expired() {
+				delete(sessions, k)
+				close(s.done)
+				continue
+			}
+			active = append(active, s)
+		}
+		sessionLock.Unlock()
+		for _, s := range active {
+			s.redeliver(false)
+		}
+	}
+}
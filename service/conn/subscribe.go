@@ -0,0 +1,78 @@
+package conn
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gridsx/micro-conf/service/app"
+)
+
+// SvcSubscription 订阅的服务， 由 app 与 group 确定
+type SvcSubscription struct {
+	App   string `json:"app"`
+	Group string `json:"group"`
+}
+
+// SubscribeHandler 客户端订阅服务后， 由服务发现模块推送当前的实例列表
+type SubscribeHandler func(c *Client, services []SvcSubscription)
+
+var subscribeHandler SubscribeHandler
+
+// HandleSubscribe 注册订阅后的处理逻辑
+func HandleSubscribe(h SubscribeHandler) {
+	subscribeHandler = h
+}
+
+// 每次订阅都会替换之前订阅的服务， 为空则取消全部订阅
+// 订阅保存在会话中， 断开后在会话有效期内重连到同一节点不需要重新订阅
+func (c *Client) subscribe(services []SvcSubscription) {
+	if !app.HasScope(c.scopes, app.ScopeSvcDiscover) {
+		logger.Warnf("subscribe - client %s has no scope %s\n", c.key, app.ScopeSvcDiscover)
+		c.sendError(errors.New("credential requires scope " + app.ScopeSvcDiscover))
+		return
+	}
+	valid := make([]SvcSubscription, 0, len(services))
+	for _, s := range services {
+		if len(s.App) == 0 {
+			continue
+		}
+		if len(s.Group) == 0 {
+			s.Group = "default"
+		}
+		valid = append(valid, s)
+	}
+	c.session.lock.Lock()
+	c.session.services = valid
+	c.session.lock.Unlock()
+	if subscribeHandler != nil && len(valid) > 0 {
+		subscribeHandler(c, valid)
+	}
+}
+
+// Caller 客户端所属的app， 客户端的key 为 app:ip:port
+func (c *Client) Caller() string {
+	if idx := strings.Index(c.key, ":"); idx > 0 {
+		return c.key[:idx]
+	}
+	return ""
+}
+
+// Subscribers 本节点上订阅了各个服务的客户端key
+func Subscribers() map[SvcSubscription][]string {
+	sessionLock.Lock()
+	all := make([]*session, 0, len(sessions))
+	for _, s := range sessions {
+		all = append(all, s)
+	}
+	sessionLock.Unlock()
+
+	result := make(map[SvcSubscription][]string, len(all))
+	for _, s := range all {
+		s.lock.Lock()
+		for _, svc := range s.services {
+			result[svc] = append(result[svc], s.key)
+		}
+		s.lock.Unlock()
+	}
+	return result
+}
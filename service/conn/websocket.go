@@ -2,6 +2,7 @@ package conn
 
 import (
 	"github.com/gorilla/websocket"
+	"github.com/gridsx/micro-conf/config"
 	"github.com/gridsx/micro-conf/service/app"
 	"github.com/kataras/iris/v12"
 
@@ -37,12 +38,36 @@ func serveWs(ctx iris.Context) {
 		log.Println(err)
 		return
 	}
-	client := &Client{conn: conn, send: make(chan []byte, 256), key: key, lock: sync.Mutex{}}
+	client := &Client{conn: conn, send: make(chan []byte, 256), key: key, lock: sync.Mutex{},
+		protocol: ctx.URLParamIntDefault("protocol", ProtocolLegacy), since: time.Now(),
+		token: ctx.Values().GetString(app.TokenCtxKey), credential: ctx.Values().GetString(app.CredCtxKey)}
+	if scopes, ok := ctx.Values().Get(app.ScopeCtxKey).([]string); ok {
+		client.scopes = scopes
+	}
+	client.session = attachSession(client)
 	registerClient(client)
+	client.refreshConn()
 	go client.Read()
 	go client.Write()
+	// 重连上来的， 之前未确认的消息全部重发
+	client.session.redeliver(true)
+}
+
+// 记录连接所在的节点， 用于查看发布影响的实例连接在哪里
+// 连接期间节点与协议都不会变， 只在建立连接以及记录快要过期时写入， 避免每个心跳都写一次raft
+func (c *Client) refreshConn() {
+	if !c.connAt.IsZero() && time.Since(c.connAt) < app.ConnRefresh {
+		return
+	}
+	info := &app.ConnInfo{Node: config.App.Raft.PeerId, Protocol: c.protocol, Since: c.since, Token: c.token, Credential: c.credential}
+	if err := app.SetConn(c.key, info); err != nil {
+		logger.Warnf("refreshConn - client %s err: %s\n", c.key, err.Error())
+		return
+	}
+	c.connAt = time.Now()
 }
 
 func RouteWs(a *iris.Application) {
-	a.Get("/api/ws", app.RequireToken, serveWs) // 需要token
+	// 有任意一个范围即可连接， 各类消息再按范围校验
+	a.Get("/api/ws", app.RequireScope(app.ScopeCfgRead, app.ScopeSvcRegister, app.ScopeSvcDiscover), serveWs) // 需要token
 }
@@ -12,6 +12,7 @@ import (
 func RegisterAPI(a *iris.Application) {
 	base.RouteRaft(a.Party("/api/raft"))
 	base.RouteStore(a.Party("/api/store"))
+	base.RouteAudit(a.Party("/api/audit"))
 	app.RouteApp(a.Party("/api/app"))
 	cfg.RoutConfig(a.Party("/api/cfg"))
 }
@@ -6,6 +6,6 @@ import (
 )
 
 func RouteSvc(party iris.Party) {
-	party.Use(app.RequireToken)
+	party.Use(app.RequireScope(app.ScopeSvcDiscover))
 	party.Post("/instances", getServiceInstanceList)
 }
@@ -9,6 +9,7 @@ const (
 
 	// 默认的一些耗时和group
 	defaultGroup = "default"
+	defaultSize  = 16
 )
 
 var rs = store.GetRaftStore()
@@ -24,5 +24,6 @@ func getServiceInstanceList(ctx iris.Context) {
 	if len(svc.Group) == 0 {
 		svc.Group = defaultGroup
 	}
+	app.RecordDiscovery(ctx.URLParam("app"), svc.App, svc.Group)
 	ret.Ok(ctx, app.ServiceInfos(svc))
 }
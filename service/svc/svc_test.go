@@ -1,2 +1,20 @@
 package svc
 
+import (
+	"testing"
+
+	"github.com/gridsx/micro-conf/service/conn"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnInstanceChange(t *testing.T) {
+	onInstanceChange("set", "app.instance.info.demo.default.10.0.0.1:8080", "UP")
+	onInstanceChange("set", "app.instance.meta.other.gray.10.0.0.2:8080", "{}")
+	onInstanceChange("set", "app.instance.info.broken", "UP")
+	onInstanceChange("set", "app.health.check.checked.blue", "{}")
+	dirtyLock.Lock()
+	defer dirtyLock.Unlock()
+	assert.True(t, dirty[conn.SvcSubscription{App: "demo", Group: "default"}])
+	assert.True(t, dirty[conn.SvcSubscription{App: "other", Group: "gray"}])
+	assert.True(t, dirty[conn.SvcSubscription{App: "checked", Group: "blue"}])
+}
@@ -0,0 +1,121 @@
+package svc
+
+/// 服务实例变化的推送， 每个节点只推送给连接在自己上的订阅方
+/// 实例的上下线、状态、meta 以及健康检查结果的变化通过监听状态机感知， 心跳超时过期的实例只能定时比对发现
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gridsx/micro-conf/service/app"
+	"github.com/gridsx/micro-conf/service/conn"
+)
+
+const (
+	instanceInfoPrefix   = "app.instance.info."
+	instanceMetaPrefix   = "app.instance.meta."
+	instanceHealthPrefix = "app.instance.health."
+	healthCheckPrefix    = "app.health.check."
+
+	svcPushInterval = time.Second // 合并短时间内的多次变化
+	svcRescanTicks  = 10          // 每隔多少次全量比对一次订阅的服务
+)
+
+// SvcChangeEvent 推送给订阅方的服务实例列表
+type SvcChangeEvent struct {
+	App       string            `json:"app"`
+	Group     string            `json:"group"`
+	Instances []app.ServiceInfo `json:"instances"`
+}
+
+var (
+	dirty     = make(map[conn.SvcSubscription]bool, defaultSize)
+	dirtyLock sync.Mutex
+	// 每个服务上次推送的实例列表， 只在 watchServices 协程中访问
+	snapshots = make(map[conn.SvcSubscription]string, defaultSize)
+)
+
+func init() {
+	rs.Watch(instanceInfoPrefix, onInstanceChange)
+	rs.Watch(instanceMetaPrefix, onInstanceChange)
+	rs.Watch(instanceHealthPrefix, onInstanceChange)
+	rs.Watch(healthCheckPrefix, onInstanceChange)
+	conn.HandleSubscribe(pushSubscribed)
+	go watchServices()
+}
+
+// 心跳也会刷新这些key， 这里只做标记， 由 watchServices 比对后决定是否推送
+func onInstanceChange(_, key, _ string) {
+	var rest string
+	switch {
+	case strings.HasPrefix(key, instanceInfoPrefix):
+		rest = strings.TrimPrefix(key, instanceInfoPrefix)
+	case strings.HasPrefix(key, instanceMetaPrefix):
+		rest = strings.TrimPrefix(key, instanceMetaPrefix)
+	case strings.HasPrefix(key, instanceHealthPrefix):
+		rest = strings.TrimPrefix(key, instanceHealthPrefix)
+	case strings.HasPrefix(key, healthCheckPrefix):
+		// 健康检查的定义没有实例部分， 补上以便统一解析
+		rest = strings.TrimPrefix(key, healthCheckPrefix) + "."
+	}
+	arr := strings.SplitN(rest, ".", 3)
+	if len(arr) != 3 || len(arr[0]) == 0 || len(arr[1]) == 0 {
+		return
+	}
+	dirtyLock.Lock()
+	dirty[conn.SvcSubscription{App: arr[0], Group: arr[1]}] = true
+	dirtyLock.Unlock()
+}
+
+func watchServices() {
+	ticker := time.NewTicker(svcPushInterval)
+	defer ticker.Stop()
+	tick := 0
+	for range ticker.C {
+		tick++
+		pushChanged(tick%svcRescanTicks == 0)
+	}
+}
+
+func pushChanged(rescan bool) {
+	dirtyLock.Lock()
+	changed := dirty
+	dirty = make(map[conn.SvcSubscription]bool, defaultSize)
+	dirtyLock.Unlock()
+
+	subscribers := conn.Subscribers()
+	for svc := range snapshots {
+		if _, ok := subscribers[svc]; !ok {
+			delete(snapshots, svc)
+		}
+	}
+	for svc, keys := range subscribers {
+		if !rescan && !changed[svc] {
+			continue
+		}
+		event := serviceEvent(svc)
+		d, _ := json.Marshal(event.Instances)
+		if snapshots[svc] == string(d) {
+			continue
+		}
+		snapshots[svc] = string(d)
+		for _, key := range keys {
+			conn.Deliver(key, func(c *conn.Client) { c.Push(&app.AppEvent{Type: app.SvcInfoChange, Content: event}) })
+		}
+	}
+}
+
+// 订阅后立即推送一次当前的实例列表
+func pushSubscribed(c *conn.Client, services []conn.SvcSubscription) {
+	for _, svc := range services {
+		app.RecordDiscovery(c.Caller(), svc.App, svc.Group)
+		c.Push(&app.AppEvent{Type: app.SvcInfoChange, Content: serviceEvent(svc)})
+	}
+}
+
+func serviceEvent(svc conn.SvcSubscription) *SvcChangeEvent {
+	instances := app.ServiceInfos(&app.ServiceInfo{App: svc.App, Group: svc.Group})
+	return &SvcChangeEvent{App: svc.App, Group: svc.Group, Instances: instances}
+}
@@ -5,10 +5,13 @@ type command struct {
 	Key   string `json:"key,omitempty"`
 	Value string `json:"value,omitempty"`
 	Exp   uint64 `json:"exp,omitempty"`
+	// 批量设置的key value， 在同一个事务中生效
+	Kvs map[string]string `json:"kvs,omitempty"`
 }
 
 const (
 	CmdSet   = "set"
 	CmdSetEx = "setex"
 	CmdDel   = "del"
+	CmdBatch = "batch"
 )
@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"io"
 	"runtime"
+	"strconv"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
 	"github.com/hashicorp/raft"
 )
 
+const appliedKey = "_raft.applied" // 本节点已经应用的日志序号
+
 // 有限状态机
 type fsm Store // TODO extract to db.go with the database => balloon
 
@@ -25,16 +28,32 @@ func (f *fsm) Apply(l *raft.Log) interface{} {
 	if err := json.Unmarshal(l.Data, &c); err != nil {
 		panic(fmt.Sprintf("failed to unmarshal command: %s", err.Error()))
 	}
+	var resp *fsmGenericResponse
 	switch c.Op {
 	case CmdSet:
-		return f.applySet(c.Key, c.Value)
+		resp = f.applySet(l.Index, c.Key, c.Value)
 	case CmdSetEx:
-		return f.applySet(c.Key, c.Value, c.Exp)
+		resp = f.applySet(l.Index, c.Key, c.Value, c.Exp)
 	case CmdDel:
-		return f.applyDelete(c.Key)
+		resp = f.applyDelete(l.Index, c.Key)
+	case CmdBatch:
+		resp = f.applyBatch(l.Index, c.Kvs)
 	default:
 		return &fsmGenericResponse{error: errors.New("unknown command")}
 	}
+	// 启动时重放的日志在上次运行时已经通知过， 不再通知
+	if resp.error != nil || l.Index <= f.replayed {
+		return resp
+	}
+	// 通知本节点上监听了此key的模块
+	if c.Op == CmdBatch {
+		for k, v := range c.Kvs {
+			(*Store)(f).notify(&command{Op: CmdSet, Key: k, Value: v})
+		}
+	} else {
+		(*Store)(f).notify(&c)
+	}
+	return resp
 }
 
 // Snapshot returns a snapshot of the key-value store.
@@ -45,17 +64,42 @@ func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
 }
 
 // Restore stores the key-value store to a previous state.
+// 运行中通过快照追上leader 的， 快照中的变更没有经过Apply， 需要对比前后被监听的key 并通知
+// 启动时的快照比本地的数据旧， 之后重放的日志会恢复本地的数据， 不需要通知
 func (f *fsm) Restore(rc io.ReadCloser) error {
+	s := (*Store)(f)
+	running := s.raft != nil
+	var before map[string]string
+	if running {
+		before = s.watchedKvs()
+	}
 	// Set the state from the snapshot, no lock required according to
 	// Hashicorp docs.
 	err := f.data.Load(rc, runtime.NumCPU()*2)
 	if err != nil {
 		return err
 	}
+	if running {
+		s.notifyChanged(before, s.watchedKvs())
+	}
 	return nil
 }
 
-func (f *fsm) applySet(key, value string, exp ...uint64) interface{} {
+// 已经应用的日志序号与数据在同一个事务中写入， 重启后据此判断哪些日志是重放的
+func setApplied(txn *badger.Txn, index uint64) error {
+	return txn.Set([]byte(appliedKey), []byte(strconv.FormatUint(index, 10)))
+}
+
+func (s *Store) appliedIndex() uint64 {
+	v, err := s.Get(appliedKey)
+	if err != nil {
+		return 0
+	}
+	index, _ := strconv.ParseUint(v, 10, 64)
+	return index
+}
+
+func (f *fsm) applySet(index uint64, key, value string, exp ...uint64) *fsmGenericResponse {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
@@ -70,16 +114,37 @@ func (f *fsm) applySet(key, value string, exp ...uint64) interface{} {
 			millis := (exp[0] - uint64(time.Now().UnixMilli())) * uint64(time.Millisecond)
 			e = e.WithTTL(time.Duration(millis))
 		}
-		return txn.SetEntry(e)
+		if err := txn.SetEntry(e); err != nil {
+			return err
+		}
+		return setApplied(txn, index)
 	})
 	return &fsmGenericResponse{error: err}
 }
 
-func (f *fsm) applyDelete(key string) interface{} {
+func (f *fsm) applyDelete(index uint64, key string) *fsmGenericResponse {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 	err := f.data.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
+		if err := txn.Delete([]byte(key)); err != nil {
+			return err
+		}
+		return setApplied(txn, index)
+	})
+	return &fsmGenericResponse{error: err}
+}
+
+// 批量设置， 要么全部成功， 要么全部失败
+func (f *fsm) applyBatch(index uint64, kvs map[string]string) *fsmGenericResponse {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	err := f.data.Update(func(txn *badger.Txn) error {
+		for k, v := range kvs {
+			if err := txn.Set([]byte(k), []byte(v)); err != nil {
+				return err
+			}
+		}
+		return setApplied(txn, index)
 	})
 	return &fsmGenericResponse{error: err}
 }
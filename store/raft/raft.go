@@ -31,6 +31,13 @@ type Store struct {
 	//data map[string]string // the key-value store for the system
 
 	raft *raft.Raft // the consensus mechanism
+
+	watchLock sync.RWMutex
+	watchers  []watcher
+	eventLock sync.Mutex
+	events    []*command
+	wakeup    chan struct{}
+	replayed  uint64 // 启动前已经应用过的日志序号， 重放这些日志时不通知
 }
 
 func (s *Store) Raft() *raft.Raft {
@@ -48,7 +55,10 @@ func (s *Store) Open(enableSingle bool, localID string) error {
 		return err
 	}
 	s.data = db
+	s.replayed = s.appliedIndex()
 	go runBadgerGC(db)
+	s.wakeup = make(chan struct{}, 1)
+	go s.dispatch()
 
 	// Setup Raft configuration
 	config := raft.DefaultConfig()
@@ -169,6 +179,42 @@ func (s *Store) ScanKeys(p string) []string {
 	return result
 }
 
+// ScanRange 按key 倒序遍历 [from, to) 范围内的key value， fn 返回false 时停止
+// 用于key 中带有时间的数据按时间范围分页， 不需要读出整个前缀下的数据
+func (s *Store) ScanRange(from, to string, fn func(k, v string) bool) {
+	err := s.data.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Reverse = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek([]byte(to)); it.Valid(); it.Next() {
+			item := it.Item()
+			k := string(item.Key())
+			if k >= to {
+				continue
+			}
+			if k < from {
+				return nil
+			}
+			next := true
+			err := item.Value(func(v []byte) error {
+				next = fn(k, string(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if !next {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.GetLogger(nil).Errorln("ScanRange - error scanning range " + err.Error())
+	}
+}
+
 // Set sets the value for the given key.
 func (s *Store) Set(key, value string, exp int64) error {
 	cmd := CmdSet
@@ -197,6 +243,22 @@ func (s *Store) Set(key, value string, exp int64) error {
 	return f.Error()
 }
 
+// SetBatch 原子地设置多个key， 不设置过期时间
+func (s *Store) SetBatch(kvs map[string]string) error {
+	if len(kvs) == 0 {
+		return nil
+	}
+	if s.raft.State() != raft.Leader {
+		return RedirectBatchRequest(s.raft, kvs)
+	}
+	b, err := json.Marshal(&command{Op: CmdBatch, Kvs: kvs})
+	if err != nil {
+		return err
+	}
+	f := s.raft.Apply(b, raftTimeout)
+	return f.Error()
+}
+
 // Delete deletes the given key.
 func (s *Store) Delete(key string) error {
 	cmd := CmdDel
@@ -204,7 +266,7 @@ func (s *Store) Delete(key string) error {
 		return RedirectKeyRequest(s.raft, cmd, key, "", 0)
 	}
 	c := &command{
-		Op:  "delete",
+		Op:  CmdDel,
 		Key: key,
 	}
 	b, err := json.Marshal(c)
@@ -3,7 +3,6 @@ package raft
 import (
 	"github.com/gridsx/micro-conf/config"
 	"github.com/hashicorp/raft"
-	"github.com/winjeg/go-commons/cryptos"
 	"github.com/winjeg/go-commons/http"
 
 	"encoding/json"
@@ -20,7 +19,6 @@ const (
 )
 
 var cfg = config.App
-var token = cryptos.Sha1([]byte(cfg.JWT.Secret))
 
 // RedirectKeyRequest redirect the request to leader node
 func RedirectKeyRequest(rs *raft.Raft, cmd, k, v string, exp int64) error {
@@ -36,6 +34,20 @@ func RedirectKeyRequest(rs *raft.Raft, cmd, k, v string, exp int64) error {
 	return requestRemote(addr, keyPath, contentMap)
 }
 
+// RedirectBatchRequest redirect the batch set request to leader node
+func RedirectBatchRequest(rs *raft.Raft, kvs map[string]string) error {
+	clusterInfo := NewClusterInfo(rs)
+	if clusterInfo == nil {
+		return errors.New("wrong cluster info")
+	}
+	addr, err := getLeaderAddr(clusterInfo.LeaderAddr)
+	if err != nil {
+		return err
+	}
+	contentMap := map[string]interface{}{"cmd": CmdBatch, "kvs": kvs}
+	return requestRemote(addr, keyPath, contentMap)
+}
+
 // RedirectRaftRequest redirect raft operation to leader node
 func RedirectRaftRequest(rs *raft.Raft, nodeId, addr string) error {
 	clusterInfo := NewClusterInfo(rs)
@@ -52,7 +64,7 @@ func RedirectRaftRequest(rs *raft.Raft, nodeId, addr string) error {
 
 func requestRemote(addr, path string, contentMap map[string]interface{}) error {
 	d, _ := json.Marshal(contentMap)
-	respStr, err := http.DoRequest("POST", addr+path, string(d), http2.Header{"_inner_auth": []string{token}})
+	respStr, err := http.DoRequest("POST", addr+path, string(d), http2.Header{config.InnerAuthHeader: []string{config.InnerToken()}})
 	if err != nil {
 		return err
 	}
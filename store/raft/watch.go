@@ -0,0 +1,107 @@
+package raft
+
+import (
+	"strings"
+)
+
+const warnPendingEvents = 4096
+
+// Watcher 状态机应用了某个key的变更后回调， 集群内每个节点都会回调， 用于各节点感知数据的变化
+// 回调在单独的协程中按照日志的顺序执行， 不应长时间阻塞
+// 待回调的变更放在不限长度的队列中， 回调再慢也不会阻塞状态机应用日志
+type Watcher func(op, key, value string)
+
+type watcher struct {
+	prefix string
+	fn     Watcher
+}
+
+// Watch 监听指定前缀的key的变更
+func (s *Store) Watch(prefix string, w Watcher) {
+	s.watchLock.Lock()
+	defer s.watchLock.Unlock()
+	s.watchers = append(s.watchers, watcher{prefix: prefix, fn: w})
+}
+
+func (s *Store) matchedWatchers(key string) []watcher {
+	s.watchLock.RLock()
+	defer s.watchLock.RUnlock()
+	result := make([]watcher, 0, len(s.watchers))
+	for _, w := range s.watchers {
+		if strings.HasPrefix(key, w.prefix) {
+			result = append(result, w)
+		}
+	}
+	return result
+}
+
+// 被监听的前缀下所有的key 与值
+func (s *Store) watchedKvs() map[string]string {
+	s.watchLock.RLock()
+	prefixes := make([]string, 0, len(s.watchers))
+	for _, w := range s.watchers {
+		prefixes = append(prefixes, w.prefix)
+	}
+	s.watchLock.RUnlock()
+	result := make(map[string]string, defaultSize)
+	for _, p := range prefixes {
+		for k, v := range s.ScanKvs(p) {
+			result[k] = v
+		}
+	}
+	return result
+}
+
+// 对比前后的值， 新增或者变化的通知为设置， 不存在了的通知为删除
+func (s *Store) notifyChanged(before, after map[string]string) {
+	for k, v := range after {
+		if old, ok := before[k]; !ok || old != v {
+			s.notify(&command{Op: CmdSet, Key: k, Value: v})
+		}
+	}
+	for k := range before {
+		if _, ok := after[k]; !ok {
+			s.notify(&command{Op: CmdDel, Key: k})
+		}
+	}
+}
+
+func (s *Store) notify(c *command) {
+	if s.wakeup == nil || len(s.matchedWatchers(c.Key)) == 0 {
+		return
+	}
+	s.eventLock.Lock()
+	s.events = append(s.events, c)
+	pending := len(s.events)
+	s.eventLock.Unlock()
+	if pending%warnPendingEvents == 0 {
+		logger.Warnf("watcher - %d events pending, watchers are slow\n", pending)
+	}
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Store) dispatch() {
+	for range s.wakeup {
+		s.eventLock.Lock()
+		events := s.events
+		s.events = nil
+		s.eventLock.Unlock()
+		for _, c := range events {
+			for _, w := range s.matchedWatchers(c.Key) {
+				callWatcher(w, c)
+			}
+		}
+	}
+}
+
+func callWatcher(w watcher, c *command) {
+	defer func() {
+		if err := recover(); err != nil {
+			logger.Errorf("watcher - handle key %s err: %v\n", c.Key, err)
+		}
+	}()
+	w.fn(c.Op, c.Key, c.Value)
+}
@@ -18,9 +18,15 @@ type RaftStore interface {
 	// ScanKeys 仅扫描KEY
 	ScanKeys(p string) []string
 
+	// ScanRange 按key 倒序遍历 [from, to) 范围内的Key value， fn 返回false 时停止
+	ScanRange(from, to string, fn func(k, v string) bool)
+
 	// Set sets the value for the given key, via distributed consensus
 	Set(key, value string, exp int64) error
 
+	// SetBatch sets multiple keys atomically, via distributed consensus
+	SetBatch(kvs map[string]string) error
+
 	// Delete removes the given key, via distributed consensus
 	Delete(key string) error
 
@@ -29,6 +35,9 @@ type RaftStore interface {
 
 	Remove(nodeID, addr string) error
 
+	// Watch 监听指定前缀的key在本节点状态机上的变更
+	Watch(prefix string, w ra.Watcher)
+
 	Raft() *raft.Raft
 }
 
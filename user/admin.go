@@ -7,11 +7,15 @@ import (
 	"time"
 
 	"github.com/gridsx/micro-conf/config"
+	"github.com/gridsx/micro-conf/user/session"
+	"github.com/kataras/iris/v12"
 	"github.com/winjeg/go-commons/log"
+	"github.com/winjeg/irisword/ret"
 )
 
 const (
-	adminKeyPattern = "user.admin.%s"
+	adminKeyPattern    = "user.admin.%s"
+	disabledKeyPattern = "user.disabled.%s"
 )
 
 var (
@@ -64,3 +68,48 @@ func addAdmin(username string) error {
 	}
 	return rs.Set(fmt.Sprintf(adminKeyPattern, username), "true", -1)
 }
+
+// Disabled 被管理员禁用的用户， 如已离职的员工， 不能登录也不能作为Owner
+func Disabled(username string) bool {
+	s, err := rs.Get(fmt.Sprintf(disabledKeyPattern, username))
+	return err == nil && strings.EqualFold("true", s)
+}
+
+type disableRequest struct {
+	User     string `json:"user"`
+	Disabled bool   `json:"disabled"`
+}
+
+// 管理员禁用或者启用用户
+func disableUser(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	if userInfo == nil || !IsAdmin(userInfo.Username) {
+		ret.Unauthorized(ctx, "require admin")
+		return
+	}
+	req := new(disableRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if u, _ := FindUser(req.User); u == nil {
+		ret.BadRequest(ctx, "user does not exist")
+		return
+	}
+	if req.User == userInfo.Username {
+		ret.BadRequest(ctx, "can not disable yourself")
+		return
+	}
+	key := fmt.Sprintf(disabledKeyPattern, req.User)
+	var err error
+	if req.Disabled {
+		err = rs.Set(key, "true", -1)
+	} else {
+		err = rs.Delete(key)
+	}
+	if err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
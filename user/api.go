@@ -32,6 +32,8 @@ func RegisterAPI(app *iris.Application) {
 	// 其他接口校验 session
 	app.Use(middleware.JWTSession)
 	party.Get("/logout", logout)
+	party.Post("/disable", disableUser)
+	routeTeam(party)
 	party.Get("/info", func(ctx iris.Context) {
 		userInfo := middleware.GetFromJWT(ctx)
 		ret.Ok(ctx, userInfo)
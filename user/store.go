@@ -27,7 +27,7 @@ func loginValid(loginInfo *User) (bool, *User) {
 		return false, nil
 	}
 	userInfo, err := FindUser(loginInfo.Username)
-	if err != nil {
+	if err != nil || Disabled(loginInfo.Username) {
 		return false, nil
 	}
 	sha1 := cryptos.Sha1([]byte(loginInfo.Password))
@@ -0,0 +1,233 @@
+package user
+
+/// 团队， 包含成员与维护者， 可以作为一个整体被授予app 的角色
+/// 授权时以 team:名称 的形式与用户名一起保存在角色列表中
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gridsx/micro-conf/user/session"
+	"github.com/kataras/iris/v12"
+	"github.com/winjeg/go-commons/str"
+	"github.com/winjeg/irisword/ret"
+)
+
+const (
+	teamKeyPattern  = "user.team.%s"
+	teamScanPattern = "user.team."
+	teamPrefix      = "team:"
+	// 团队被授予角色的app 列表， 与app 模块中用户的app 列表是同一个key
+	teamAppsPattern = "user.app.list.%s"
+)
+
+type Team struct {
+	Name        string   `json:"name"`
+	Detail      string   `json:"detail,omitempty"`
+	Members     []string `json:"members"`
+	Maintainers []string `json:"maintainers"` // 维护者可以管理成员， 同时也是成员
+	Creator     string   `json:"creator,omitempty"`
+	CreateTime  string   `json:"createTime"`
+}
+
+func (t *Team) String() string {
+	d, _ := json.Marshal(t)
+	return string(d)
+}
+
+func (t *Team) isMember(username string) bool {
+	return str.Contains(t.Members, username) || str.Contains(t.Maintainers, username)
+}
+
+// 维护者或者管理员可以管理团队
+func (t *Team) manageable(username string) bool {
+	return str.Contains(t.Maintainers, username) || IsAdmin(username)
+}
+
+// TeamPrincipal 团队在角色列表中的表示
+func TeamPrincipal(name string) string {
+	return teamPrefix + name
+}
+
+// Principals 用户以及其所在的团队， 用于判断角色
+func Principals(username string) []string {
+	result := []string{username}
+	for _, t := range allTeams() {
+		if t.isMember(username) {
+			result = append(result, TeamPrincipal(t.Name))
+		}
+	}
+	return result
+}
+
+func FindTeam(name string) (*Team, error) {
+	v, err := rs.Get(fmt.Sprintf(teamKeyPattern, name))
+	if err != nil {
+		return nil, err
+	}
+	t := new(Team)
+	if err := json.Unmarshal([]byte(v), t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func saveTeam(t *Team) error {
+	return rs.Set(fmt.Sprintf(teamKeyPattern, t.Name), t.String(), -1)
+}
+
+func allTeams() []*Team {
+	kvs := rs.ScanKvs(teamScanPattern)
+	result := make([]*Team, 0, len(kvs))
+	for _, v := range kvs {
+		t := new(Team)
+		if err := json.Unmarshal([]byte(v), t); err != nil {
+			continue
+		}
+		result = append(result, t)
+	}
+	return result
+}
+
+func routeTeam(party iris.Party) {
+	party.Get("/teams", func(ctx iris.Context) { ret.Ok(ctx, allTeams()) })
+	party.Get("/team/{name:string}", teamDetail)
+	party.Post("/team", createTeam)
+	party.Post("/team/{name:string}/member", manageMember)
+	party.Delete("/team/{name:string}", deleteTeam)
+}
+
+func teamDetail(ctx iris.Context) {
+	t, err := FindTeam(ctx.Params().Get("name"))
+	if err != nil {
+		ret.BadRequest(ctx, "team does not exist")
+		return
+	}
+	ret.Ok(ctx, t)
+}
+
+// 创建者成为团队的维护者
+func createTeam(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	if userInfo == nil {
+		ret.Unauthorized(ctx)
+		return
+	}
+	t := new(Team)
+	if err := ctx.ReadJSON(t); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if len(t.Name) == 0 || strings.ContainsAny(t.Name, ",.:") {
+		ret.BadRequest(ctx, "team name illegal")
+		return
+	}
+	if existed, _ := FindTeam(t.Name); existed != nil {
+		ret.BadRequest(ctx, "team already exists")
+		return
+	}
+	t.Creator = userInfo.Username
+	t.CreateTime = time.Now().Format(time.RFC3339)
+	t.Members = make([]string, 0)
+	t.Maintainers = []string{userInfo.Username}
+	if err := saveTeam(t); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, t)
+}
+
+type memberRequest struct {
+	Action     string `json:"action"`
+	User       string `json:"user"`
+	Maintainer bool   `json:"maintainer,omitempty"`
+}
+
+func manageMember(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	t, err := FindTeam(ctx.Params().Get("name"))
+	if err != nil {
+		ret.BadRequest(ctx, "team does not exist")
+		return
+	}
+	if userInfo == nil || !t.manageable(userInfo.Username) {
+		ret.Unauthorized(ctx, "require maintainer of team")
+		return
+	}
+	req := new(memberRequest)
+	if err := ctx.ReadJSON(req); err != nil {
+		ret.BadRequest(ctx, err.Error())
+		return
+	}
+	if u, _ := FindUser(req.User); u == nil {
+		ret.BadRequest(ctx, "user does not exist")
+		return
+	}
+	t.Members, t.Maintainers = removeItem(t.Members, req.User), removeItem(t.Maintainers, req.User)
+	switch req.Action {
+	case "add":
+		if req.Maintainer {
+			t.Maintainers = append(t.Maintainers, req.User)
+		} else {
+			t.Members = append(t.Members, req.User)
+		}
+	case "remove", "del":
+	default:
+		ret.BadRequest(ctx, "unknown action")
+		return
+	}
+	if len(t.Maintainers) == 0 {
+		ret.BadRequest(ctx, "team should have at least one maintainer")
+		return
+	}
+	if err := saveTeam(t); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx, t)
+}
+
+func deleteTeam(ctx iris.Context) {
+	userInfo := session.GetUserInfo(ctx)
+	t, err := FindTeam(ctx.Params().Get("name"))
+	if err != nil {
+		ret.BadRequest(ctx, "team does not exist")
+		return
+	}
+	if userInfo == nil || !t.manageable(userInfo.Username) {
+		ret.Unauthorized(ctx, "require maintainer of team")
+		return
+	}
+	// 还有授权的不能删除， 否则任何人都可以重新创建同名的团队继承这些授权
+	if apps, _ := rs.Get(fmt.Sprintf(teamAppsPattern, TeamPrincipal(t.Name))); len(strings.Trim(apps, ", ")) > 0 {
+		ret.BadRequest(ctx, "team still has roles on apps: "+apps+", remove them first")
+		return
+	}
+	if err := rs.Delete(fmt.Sprintf(teamKeyPattern, t.Name)); err != nil {
+		ret.ServerError(ctx, err.Error())
+		return
+	}
+	ret.Ok(ctx)
+}
+
+func removeItem(arr []string, item string) []string {
+	result := make([]string, 0, len(arr))
+	for _, v := range arr {
+		if v != item {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// PrincipalExists 用户或者团队（team:名称）是否存在， 没有成员的团队视为不存在
+func PrincipalExists(principal string) bool {
+	if strings.HasPrefix(principal, teamPrefix) {
+		t, _ := FindTeam(strings.TrimPrefix(principal, teamPrefix))
+		return t != nil && len(t.Members)+len(t.Maintainers) > 0
+	}
+	u, _ := FindUser(principal)
+	return u != nil
+}
@@ -3,6 +3,7 @@ package user
 import (
 	"errors"
 
+	"github.com/gridsx/micro-conf/service/audit"
 	"github.com/gridsx/micro-conf/user/session"
 	"github.com/kataras/iris/v12"
 	"github.com/winjeg/irisword/ret"
@@ -31,6 +32,7 @@ func register(ctx iris.Context) {
 		ret.ServerError(ctx, err.Error())
 		return
 	}
+	audit.RecordAs(ctx, info.Username, "user.register", "user:"+info.Username, nil, nil)
 	ret.Ok(ctx)
 }
 
@@ -42,8 +44,11 @@ func login(ctx iris.Context) (interface{}, error) {
 		return nil, err
 	}
 	if ok, user := loginValid(info); ok {
+		audit.RecordAs(ctx, info.Username, "user.login", "user:"+info.Username, nil, nil)
 		return *user, nil
 	}
+	// 可能被暴力尝试大量触发， 合并记录
+	audit.RecordThrottled(ctx, info.Username, "user.login.failed", "user:"+info.Username)
 	return nil, errors.New("password not correct")
 }
 